@@ -1,8 +1,14 @@
 package driver
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/flaub/ergo"
 	. "github.com/flaub/kissdif"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var drivers = make(map[string]Driver)
@@ -32,15 +38,316 @@ type Driver interface {
 	Configure(name string, config Dictionary) (Database, *ergo.Error)
 }
 
+// Locator is implemented by a driver that keeps a database's contents in
+// files, so that no two databases are configured over the same ones. Path
+// returns where a config keeps them, or "" if it keeps them in memory.
+type Locator interface {
+	Path(config Dictionary) string
+}
+
 type Database interface {
 	Name() string
 	Driver() string
 	Config() Dictionary
 	GetTable(name string, create bool) (Table, *ergo.Error)
+	DropTable(name string) *ergo.Error
+	ListTables() ([]string, *ergo.Error)
+	// Drop releases every resource held by the database and discards its
+	// contents. The database must not be used afterwards.
+	Drop() *ergo.Error
+	// Close releases every resource held by the database, keeping its
+	// contents. The database must not be used afterwards.
+	Close() *ergo.Error
+	// Begin starts a transaction over the database's tables.
+	Begin() (Tx, *ergo.Error)
+}
+
+// Tx is a set of reads and writes across the tables of a database that
+// takes effect as a whole on Commit, or not at all. Reads see the
+// transaction's own writes, and a write that fails leaves the transaction
+// as it was. Once Commit or Rollback is called, every method returns
+// EBadTx. A Tx is safe for concurrent use.
+type Tx interface {
+	Get(ctx context.Context, table string, query *Query) (chan (*Record), *ergo.Error)
+	Put(table string, record *Record) (string, *ergo.Error)
+	Delete(table, id, rev string) (string, *ergo.Error)
+	Commit() *ergo.Error
+	Rollback() *ergo.Error
 }
 
+// Serial is implemented by a database that serves one operation at a time,
+// such as a sql database limited to a single connection. An open
+// transaction would hold up every other use of it until it finished.
+type Serial interface {
+	Serial() bool
+}
+
+// Table is a named set of records. The channels returned by Get and Changes
+// are closed early once ctx is done, releasing whatever the query holds.
+// Neither holds the table while a record waits to be received, so that the
+// caller may write to it in between. Get may also fail after sending some
+// records, which a context from WithFailure reports.
 type Table interface {
-	Get(query *Query) (chan (*Record), *ergo.Error)
+	Get(ctx context.Context, query *Query) (chan (*Record), *ergo.Error)
 	Put(record *Record) (string, *ergo.Error)
-	Delete(id string) *ergo.Error
+	// Delete replaces the record with a tombstone and returns the
+	// tombstone's revision, or "" if there was no record to delete.
+	Delete(id, rev string) (string, *ergo.Error)
+	// PutMany puts the records in order, deleting those with Deleted set.
+	// If atomic is set, the first failure is returned and nothing is
+	// written. Otherwise each record is written on its own and any failure
+	// is reported in its result.
+	PutMany(records []*Record, atomic bool) ([]*BulkResult, *ergo.Error)
+	// ListIndexes returns the indexes with keys, along with those defined.
+	ListIndexes() ([]string, *ergo.Error)
+	// DefineIndex makes the table compute the keys of an index from each
+	// document put from then on, and from the documents it already holds.
+	// Defining an index again replaces its definition.
+	DefineIndex(def *IndexDef) *ergo.Error
+	ListIndexDefs() ([]*IndexDef, *ergo.Error)
+	// Changes streams the latest change to each record made after the
+	// update sequence since, in sequence order, and closes the channel.
+	Changes(ctx context.Context, since uint64) (chan (*Change), *ergo.Error)
+	// Watch returns a channel that is closed once the table has a change
+	// after the update sequence since, which may already be the case.
+	Watch(since uint64) (<-chan struct{}, *ergo.Error)
+}
+
+// DecodeDoc decodes a document stored as JSON, keeping numbers as
+// json.Number as IndexDef.Keys expects.
+func DecodeDoc(doc string) (interface{}, *ergo.Error) {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var result interface{}
+	err := dec.Decode(&result)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	return result, nil
+}
+
+// ExportDoc decodes a document stored as JSON for returning to a client.
+// Integral numbers are kept as int64, so that they stay integers in wire
+// formats other than JSON, such as msgpack; others become float64.
+func ExportDoc(doc string) (interface{}, *ergo.Error) {
+	result, kerr := DecodeDoc(doc)
+	if kerr != nil {
+		return nil, kerr
+	}
+	return exportNumbers(result), nil
+}
+
+func exportNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = exportNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = exportNumbers(item)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	}
+	return value
+}
+
+// ComputeKeys returns the keys of a record whose document is stored as doc:
+// those it was put with, except that the keys of each defined index are
+// computed from the document instead.
+func ComputeKeys(defs []*IndexDef, keys IndexMap, doc string) (IndexMap, *ergo.Error) {
+	if len(defs) == 0 {
+		return keys, nil
+	}
+	decoded, kerr := DecodeDoc(doc)
+	if kerr != nil {
+		return nil, kerr
+	}
+	result := make(IndexMap)
+	for name, values := range keys {
+		result[name] = values
+	}
+	for _, def := range defs {
+		delete(result, def.Name)
+		values := def.Keys(decoded)
+		if len(values) != 0 {
+			result[def.Name] = values
+		}
+	}
+	return result, nil
+}
+
+// Compaction is the policy for purging tombstones, read from the
+// "tombstone_ttl" (a duration such as "72h") and "tombstone_max" (a count
+// per table) config keys. Zero values keep tombstones forever. Drivers purge
+// them when a table is written to and when the database is opened.
+type Compaction struct {
+	TTL time.Duration
+	Max int
+}
+
+func NewCompaction(config Dictionary) (Compaction, *ergo.Error) {
+	var this Compaction
+	if str, ok := config["tombstone_ttl"]; ok {
+		ttl, err := time.ParseDuration(str)
+		if err != nil || ttl < 0 {
+			return this, NewError(EBadParam, "name", "tombstone_ttl", "value", str)
+		}
+		this.TTL = ttl
+	}
+	if str, ok := config["tombstone_max"]; ok {
+		max, err := strconv.Atoi(str)
+		if err != nil || max < 0 {
+			return this, NewError(EBadParam, "name", "tombstone_max", "value", str)
+		}
+		this.Max = max
+	}
+	return this, nil
+}
+
+// Expired reports whether a tombstone made at mtime should be purged, given
+// that count tombstones are being kept.
+func (this Compaction) Expired(mtime time.Time, count int, now time.Time) bool {
+	if this.Max != 0 && count > this.Max {
+		return true
+	}
+	return this.TTL != 0 && now.Sub(mtime) > this.TTL
+}
+
+// WaitChanges collects the changes to table after since. If there are none
+// yet, it waits up to timeout for the first to arrive, or until ctx is done.
+func WaitChanges(ctx context.Context, table Table, since uint64, timeout time.Duration) (*ChangeSet, *ergo.Error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	result := &ChangeSet{
+		LastSeq: since,
+		Changes: []*Change{},
+	}
+	for {
+		watch, kerr := table.Watch(result.LastSeq)
+		if kerr != nil {
+			return nil, kerr
+		}
+		ch, kerr := table.Changes(ctx, result.LastSeq)
+		if kerr != nil {
+			return nil, kerr
+		}
+		for change := range ch {
+			result.Changes = append(result.Changes, change)
+			result.LastSeq = change.Seq
+		}
+		if len(result.Changes) != 0 || timer == nil {
+			return result, nil
+		}
+		select {
+		case <-watch:
+		case <-timer:
+			return result, nil
+		case <-ctx.Done():
+			return result, nil
+		}
+	}
+}
+
+// PageSize is how many records Stream reads at a time.
+const PageSize = 100
+
+// Failure holds the error that ends the records sent by Get early, which
+// would otherwise look like a result cut short by its limit.
+type Failure struct {
+	mutex sync.Mutex
+	err   *ergo.Error
+}
+
+type failureKey struct{}
+
+// WithFailure returns a context that makes Get report the error that ends
+// its records early to the returned Failure.
+func WithFailure(ctx context.Context) (context.Context, *Failure) {
+	failure := new(Failure)
+	return context.WithValue(ctx, failureKey{}, failure), failure
+}
+
+// Err returns the error that ended the records early, if any. It is set
+// by the time the channel is closed.
+func (this *Failure) Err() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.err
+}
+
+func fail(ctx context.Context, kerr *ergo.Error) {
+	failure, ok := ctx.Value(failureKey{}).(*Failure)
+	if !ok {
+		return
+	}
+	failure.mutex.Lock()
+	defer failure.mutex.Unlock()
+	failure.err = kerr
+}
+
+// Page reads up to query.Limit records and reports whether more follow. It
+// lets go of whatever it reads them from before returning.
+type Page func(query *Query) ([]*Record, bool, *ergo.Error)
+
+// Stream sends the records found by query, followed by nil if that was all
+// of them, reading them a page at a time so that the table is free while
+// they wait to be received. Each page after the first resumes after the
+// last record sent, so writes made in between may show up in later pages.
+func Stream(ctx context.Context, query *Query, page Page) (chan (*Record), *ergo.Error) {
+	records, more, kerr := page(pageQuery(query, query.Limit))
+	if kerr != nil {
+		return nil, kerr
+	}
+	ch := make(chan (*Record))
+	go func() {
+		defer close(ch)
+		var sent uint
+		for {
+			for _, record := range records {
+				select {
+				case ch <- record:
+				case <-ctx.Done():
+					return
+				}
+				sent++
+			}
+			if !more {
+				select {
+				case ch <- nil:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if sent == query.Limit || len(records) == 0 {
+				return
+			}
+			next := pageQuery(query, query.Limit-sent)
+			next.After = records[len(records)-1].Cursor
+			records, more, kerr = page(next)
+			if kerr != nil {
+				fail(ctx, kerr)
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// pageQuery returns a copy of query reading at most PageSize of the limit
+// records left.
+func pageQuery(query *Query, limit uint) *Query {
+	result := *query
+	result.Limit = limit
+	if limit > PageSize {
+		result.Limit = PageSize
+	}
+	return &result
 }
@@ -0,0 +1,265 @@
+package mem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/flaub/ergo"
+	. "github.com/flaub/kissdif"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	snapshotFile    = "snapshot"
+	walFile         = "wal"
+	defaultSnapshot = 1000
+)
+
+// journal makes a database durable by appending every change to a
+// write-ahead log, and by periodically replacing the log with a snapshot
+// of all tables.
+type journal struct {
+	dir    string
+	wal    *os.File
+	size   int64       // length of the log's complete entries
+	failed *ergo.Error // set once the log can't be trusted, refusing writes
+	count  int         // entries appended since the last snapshot
+	every  int         // entries between snapshots
+	mutex  sync.Mutex
+}
+
+type entry struct {
+	Op     string
+	Table  string
+	Record *Record   `json:",omitempty"`
+	Seq    uint64    `json:",omitempty"` // a change's, or for opCreate the table's, sequence
+	Time   int64     `json:",omitempty"` // when a delete happened, in nanoseconds
+	Batch  []*entry  `json:",omitempty"` // puts and deletes made together
+	Index  *IndexDef `json:",omitempty"` // for opIndex
+}
+
+const (
+	opCreate = "create"
+	opDrop   = "drop"
+	opPut    = "put"
+	opDelete = "delete"
+	opPurge  = "purge"
+	opBatch  = "batch"
+	opIndex  = "index"
+)
+
+// openJournal replays the snapshot and log found in the directory named by
+// the "dir" config key into db, and leaves the log open for appending.
+func openJournal(db *Database, config Dictionary) (*journal, *ergo.Error) {
+	this := &journal{
+		dir:   config["dir"],
+		every: defaultSnapshot,
+	}
+	if str, ok := config["snapshot"]; ok {
+		every, err := strconv.Atoi(str)
+		if err != nil || every <= 0 {
+			return nil, NewError(EBadParam, "name", "snapshot", "value", str)
+		}
+		this.every = every
+	}
+	err := os.MkdirAll(this.dir, 0755)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	_, kerr := this.replay(db, filepath.Join(this.dir, snapshotFile))
+	if kerr != nil {
+		return nil, kerr
+	}
+	this.count = 0
+	path := filepath.Join(this.dir, walFile)
+	good, kerr := this.replay(db, path)
+	if kerr != nil {
+		return nil, kerr
+	}
+	this.wal, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	// discard a partially written entry left behind by a crash
+	err = this.wal.Truncate(good)
+	if err == nil {
+		_, err = this.wal.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		this.wal.Close()
+		return nil, Wrap(err)
+	}
+	this.size = good
+	return this, nil
+}
+
+// replay applies every complete entry in the file at path and returns the
+// offset just past the last one. Only the last entry may be incomplete,
+// having been torn by a crash; anything that fails to decode before it is
+// corruption.
+func (this *journal) replay(db *Database, path string) (int64, *ergo.Error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, Wrap(err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, Wrap(err)
+		}
+		var e entry
+		if json.Unmarshal(line, &e) != nil {
+			_, err = reader.Peek(1)
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err != nil {
+				return 0, Wrap(err)
+			}
+			return 0, NewError(EGeneric, "err", fmt.Sprintf("%s: bad entry at offset %d", path, offset))
+		}
+		db.apply(&e)
+		offset += int64(len(line))
+		this.count++
+	}
+}
+
+// append durably records e and reports whether a snapshot is due. An
+// entry that fails to be written is cut off again, since replay refuses a
+// log with a bad entry before its end; if that fails too, the journal
+// refuses every later write.
+func (this *journal) append(e *entry) (bool, *ergo.Error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.failed != nil {
+		return false, this.failed
+	}
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(e)
+	if err != nil {
+		return false, Wrap(err)
+	}
+	_, err = this.wal.Write(buf.Bytes())
+	if err == nil {
+		err = this.wal.Sync()
+	}
+	if err != nil {
+		this.rewind()
+		return false, Wrap(err)
+	}
+	this.size += int64(buf.Len())
+	this.count++
+	return this.count >= this.every, nil
+}
+
+// rewind cuts the log back to its complete entries.
+func (this *journal) rewind() {
+	err := this.wal.Truncate(this.size)
+	if err == nil {
+		_, err = this.wal.Seek(this.size, io.SeekStart)
+	}
+	if err == nil {
+		err = this.wal.Sync()
+	}
+	if err != nil {
+		this.failed = Wrap(err)
+	}
+}
+
+// snapshot writes the entries produced by fn to a new snapshot and then
+// empties the log. The caller must prevent concurrent changes.
+func (this *journal) snapshot(fn func(enc *json.Encoder) error) *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	path := filepath.Join(this.dir, snapshotFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return Wrap(err)
+	}
+	writer := bufio.NewWriter(file)
+	err = fn(json.NewEncoder(writer))
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return Wrap(err)
+	}
+	// the log may only be emptied once the rename itself is durable
+	err = syncDir(this.dir)
+	if err != nil {
+		return Wrap(err)
+	}
+	err = this.wal.Truncate(0)
+	if err == nil {
+		_, err = this.wal.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = this.wal.Sync()
+	}
+	if err != nil {
+		// replaying the old entries over the snapshot could undo later
+		// changes, so nothing may be appended after them
+		this.failed = Wrap(err)
+		return this.failed
+	}
+	this.size = 0
+	this.count = 0
+	return nil
+}
+
+// syncDir makes the entries of the directory at path durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (this *journal) close() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	err := this.wal.Close()
+	if err != nil {
+		return Wrap(err)
+	}
+	return nil
+}
+
+// remove closes the log and deletes the journal's files.
+func (this *journal) remove() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.wal.Close()
+	for _, name := range []string{walFile, snapshotFile, snapshotFile + ".tmp"} {
+		err := os.Remove(filepath.Join(this.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return Wrap(err)
+		}
+	}
+	os.Remove(this.dir)
+	return nil
+}
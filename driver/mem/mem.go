@@ -2,7 +2,7 @@ package mem
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/cznic/b"
@@ -10,17 +10,21 @@ import (
 	. "github.com/flaub/kissdif"
 	"github.com/flaub/kissdif/driver"
 	"io"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Driver struct {
 }
 
 type Database struct {
-	name   string
-	config Dictionary
-	tables map[string]*Table
-	mutex  sync.RWMutex
+	name    string
+	config  Dictionary
+	tables  map[string]*Table
+	journal *journal // nil unless the "dir" config key is set
+	policy  driver.Compaction
+	mutex   sync.RWMutex
 }
 
 type Index struct {
@@ -29,20 +33,28 @@ type Index struct {
 }
 
 type Table struct {
-	name  string
-	keys  map[string]*Index
-	mutex sync.RWMutex
+	name    string
+	db      *Database
+	keys    map[string]*Index
+	seq     uint64            // last update sequence
+	changes *b.Tree           // latest *Change for each record, by seq
+	seqs    map[string]uint64 // seq of the latest change, by id
+	watch   chan struct{}     // closed on the next change
+	tombs   *b.Tree           // deletion time of each tombstone, by seq
+	defs    []*IndexDef       // computed indexes, by name; replaced, never changed
+	dropped bool              // set once the table is dropped, refusing writes
+	mutex   sync.RWMutex
 }
 
 type recordById struct {
 	records map[string]*Record
 }
 
-type sentinel struct {
-	key string
-}
+// closed is returned by Watch when a change has already happened.
+var closed = make(chan struct{})
 
 func init() {
+	close(closed)
 	driver.Register("mem", NewDriver())
 }
 
@@ -50,11 +62,44 @@ func NewDriver() *Driver {
 	return new(Driver)
 }
 
+// Path returns the directory of the journal, if the database keeps one.
+func (this *Driver) Path(config Dictionary) string {
+	return config["dir"]
+}
+
 func (this *Driver) Configure(name string, config Dictionary) (driver.Database, *ergo.Error) {
+	policy, kerr := driver.NewCompaction(config)
+	if kerr != nil {
+		return nil, kerr
+	}
 	db := &Database{
 		name:   name,
 		config: config,
 		tables: make(map[string]*Table),
+		policy: policy,
+	}
+	if config["dir"] != "" {
+		db.journal, kerr = openJournal(db, config)
+		if kerr != nil {
+			return nil, kerr
+		}
+		now := time.Now()
+		due := false
+		for _, table := range db.tables {
+			more, kerr := table.compact(now)
+			if kerr != nil {
+				db.journal.close()
+				return nil, kerr
+			}
+			due = due || more
+		}
+		if due {
+			kerr = db.checkpoint()
+			if kerr != nil {
+				db.journal.close()
+				return nil, kerr
+			}
+		}
 	}
 	return db, nil
 }
@@ -85,16 +130,197 @@ func (this *Database) GetTable(name string, create bool) (driver.Table, *ergo.Er
 			return nil, NewError(EBadTable, "name", name)
 		}
 		// fmt.Printf("Creating new table: %v\n", name)
-		table = NewTable(name)
-		this.tables[name] = table
+		_, kerr := this.log(&entry{Op: opCreate, Table: name})
+		if kerr != nil {
+			return nil, kerr
+		}
+		table = this.createTable(name)
 	}
 	return table, nil
 }
 
+func (this *Database) createTable(name string) *Table {
+	table := NewTable(name)
+	table.db = this
+	this.tables[name] = table
+	return table
+}
+
+func (this *Database) DropTable(name string) *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	table, ok := this.tables[name]
+	if !ok {
+		return NewError(EBadTable, "name", name)
+	}
+	// writes through the table are journaled either before the drop or not
+	// at all, as replaying one after it would bring the table back
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	_, kerr := this.log(&entry{Op: opDrop, Table: name})
+	if kerr != nil {
+		return kerr
+	}
+	delete(this.tables, name)
+	table.dropped = true
+	return nil
+}
+
+// drop makes the table refuse writes.
+func (this *Table) drop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.dropped = true
+}
+
+func (this *Database) ListTables() ([]string, *ergo.Error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	names := []string{}
+	for name := range this.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (this *Database) Drop() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, table := range this.tables {
+		table.drop()
+	}
+	this.tables = make(map[string]*Table)
+	if this.journal != nil {
+		return this.journal.remove()
+	}
+	return nil
+}
+
+func (this *Database) Close() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, table := range this.tables {
+		table.drop()
+	}
+	this.tables = make(map[string]*Table)
+	if this.journal != nil {
+		return this.journal.close()
+	}
+	return nil
+}
+
+// log appends e to the journal, if there is one, and reports whether a
+// snapshot is due.
+func (this *Database) log(e *entry) (bool, *ergo.Error) {
+	if this.journal == nil {
+		return false, nil
+	}
+	return this.journal.append(e)
+}
+
+// apply replays a journal entry. It is only called while the database is
+// being configured, so no locking is needed.
+func (this *Database) apply(e *entry) {
+	table, ok := this.tables[e.Table]
+	switch e.Op {
+	case opCreate:
+		if !ok {
+			table = this.createTable(e.Table)
+		}
+		// a snapshot keeps the table's sequence, which its surviving
+		// changes may fall short of once tombstones are purged
+		if e.Seq > table.seq {
+			table.seq = e.Seq
+		}
+	case opDrop:
+		delete(this.tables, e.Table)
+	case opPut, opIndex:
+		if !ok {
+			table = this.createTable(e.Table)
+		}
+		table.replay(e)
+	case opDelete, opPurge:
+		if ok {
+			table.replay(e)
+		}
+	case opBatch:
+		for _, item := range e.Batch {
+			this.apply(item)
+		}
+	}
+}
+
+// checkpoint writes a snapshot of every table and empties the journal.
+// The database and table locks are taken before the journal's own lock,
+// in the same order used by writers. When it fails the log is left as it
+// was, so the writes are still durable, and the next write tries again.
+func (this *Database) checkpoint() *ergo.Error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.journal == nil {
+		return nil
+	}
+	names := []string{}
+	for name := range this.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table := this.tables[name]
+		table.mutex.RLock()
+		defer table.mutex.RUnlock()
+	}
+	kerr := this.journal.snapshot(func(enc *json.Encoder) error {
+		for _, name := range names {
+			table := this.tables[name]
+			err := enc.Encode(&entry{Op: opCreate, Table: name, Seq: table.seq})
+			if err != nil {
+				return err
+			}
+			for _, def := range table.defs {
+				err = enc.Encode(&entry{Op: opIndex, Table: name, Index: def})
+				if err != nil {
+					return err
+				}
+			}
+			cur, err := table.changes.SeekFirst()
+			if err == io.EOF {
+				continue
+			}
+			primary := table.getIndex("_id")
+			for {
+				_, value, err := cur.Next()
+				if err == io.EOF {
+					break
+				}
+				change := value.(*Change)
+				record, _ := primary.tree.Get(change.Id)
+				e := &entry{Op: opPut, Table: name, Record: record.(*Record), Seq: change.Seq}
+				if change.Deleted {
+					mtime, _ := table.tombs.Get(change.Seq)
+					e.Op = opDelete
+					e.Time = mtime.(time.Time).UnixNano()
+				}
+				err = enc.Encode(e)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return kerr
+}
+
 func NewTable(name string) *Table {
 	this := &Table{
-		name: name,
-		keys: make(map[string]*Index),
+		name:    name,
+		keys:    make(map[string]*Index),
+		changes: b.TreeNew(cmpSeq),
+		seqs:    make(map[string]uint64),
+		watch:   make(chan struct{}),
+		tombs:   b.TreeNew(cmpSeq),
 	}
 	this.keys["_id"] = newIndex("_id")
 	return this
@@ -111,6 +337,17 @@ func cmp(a, b interface{}) int {
 	return 0
 }
 
+func cmpSeq(a, b interface{}) int {
+	sa := a.(uint64)
+	sb := b.(uint64)
+	if sa < sb {
+		return -1
+	} else if sa > sb {
+		return 1
+	}
+	return 0
+}
+
 func newIndex(name string) *Index {
 	return &Index{
 		name: name,
@@ -119,156 +356,633 @@ func newIndex(name string) *Index {
 }
 
 func (this *Table) Put(newRecord *Record) (string, *ergo.Error) {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(newRecord.Doc)
-	if err != nil {
-		return "", Wrap(err)
+	results, kerr := this.PutMany([]*Record{newRecord}, true)
+	if kerr != nil {
+		return "", kerr
 	}
-	doc := buf.String()
-	hasher := sha1.New()
-	io.WriteString(hasher, doc)
-	rev := fmt.Sprintf("%x", hasher.Sum(nil))
+	newRecord.Rev = results[0].Rev
+	return newRecord.Rev, nil
+}
+
+func (this *Table) Delete(id, rev string) (string, *ergo.Error) {
+	results, kerr := this.PutMany([]*Record{{Id: id, Rev: rev, Deleted: true}}, true)
+	if kerr != nil {
+		return "", kerr
+	}
+	return results[0].Rev, nil
+}
 
+func (this *Table) PutMany(records []*Record, atomic bool) ([]*BulkResult, *ergo.Error) {
+	results := make([]*BulkResult, len(records))
+	docs := make([]string, len(records))
+	for i, record := range records {
+		results[i] = &BulkResult{Id: record.Id}
+		if record.Deleted {
+			continue
+		}
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(record.Doc)
+		if err != nil {
+			if atomic {
+				return nil, Wrap(err)
+			}
+			results[i].Error = Wrap(err)
+		}
+		docs[i] = buf.String()
+	}
+	due, kerr := this.write(records, docs, results, atomic)
+	if kerr != nil {
+		return nil, kerr
+	}
+	if due {
+		kerr = this.db.checkpoint()
+		if kerr != nil {
+			return nil, kerr
+		}
+	}
+	return results, nil
+}
+
+// write works out what each record turns into, journals all of it as one
+// entry and then applies it, filling in results along the way. Records
+// whose result already holds an error are skipped.
+func (this *Table) write(records []*Record, docs []string, results []*BulkResult, atomic bool) (bool, *ergo.Error) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
+	if this.dropped {
+		return false, NewError(EBadTable, "name", this.name)
+	}
+	now := time.Now()
+	pending := make(map[string]*Record)
+	batch := []*entry{}
+	for i, record := range records {
+		if results[i].Error != nil {
+			continue
+		}
+		cur, ok := pending[record.Id]
+		if !ok {
+			value, ok := this.getIndex("_id").tree.Get(record.Id)
+			if ok {
+				cur = value.(*Record)
+			}
+		}
+		next, kerr := plan(record, docs[i], cur, this.defs)
+		if kerr == nil && next != nil {
+			kerr = this.checkUnique(next, pending)
+		}
+		if kerr != nil {
+			if atomic {
+				return false, kerr
+			}
+			results[i].Error = kerr
+			continue
+		}
+		if next == nil {
+			continue
+		}
+		pending[record.Id] = next
+		results[i].Rev = next.Rev
+		e := &entry{Op: opPut, Table: this.name, Record: next, Seq: this.seq + uint64(len(batch)) + 1}
+		if next.Deleted {
+			e.Op = opDelete
+			e.Time = now.UnixNano()
+		}
+		batch = append(batch, e)
+	}
+	if len(batch) == 0 {
+		return false, nil
+	}
+	e := batch[0]
+	if len(batch) > 1 {
+		e = &entry{Op: opBatch, Table: this.name, Batch: batch}
+	}
+	due, kerr := this.log(e)
+	if kerr != nil {
+		return false, kerr
+	}
+	this.replay(e)
+	more, kerr := this.compact(now)
+	if kerr != nil {
+		// the write is made, and the purge is tried again by the next one
+		fmt.Printf("Purging tombstones failed: %v\n", kerr)
+	}
+	return due || more, nil
+}
+
+// plan returns what writing record, whose encoded document is doc, over
+// cur should store, or nil if there is nothing to do. cur is the record or
+// tombstone currently stored under the same id, if any, and defs are the
+// table's computed indexes.
+func plan(record *Record, doc string, cur *Record, defs []*IndexDef) (*Record, *ergo.Error) {
+	if record.Deleted {
+		if cur == nil || cur.Deleted {
+			return nil, nil
+		}
+		if record.Rev != cur.Rev {
+			return nil, NewError(EConflict, "id", record.Id)
+		}
+		return newTombstone(record.Id, record.Rev), nil
+	}
+	var curRev string
+	if cur != nil {
+		curRev = cur.Rev
+	}
+	// a tombstone may be replaced without knowing its revision
+	deleted := cur != nil && cur.Deleted && record.Rev == ""
+	if record.Rev != curRev && !deleted {
+		return nil, NewError(EConflict, "id", record.Id)
+	}
+	keys, kerr := driver.ComputeKeys(defs, record.Keys, doc)
+	if kerr != nil {
+		return nil, kerr
+	}
+	return &Record{
+		Id:   record.Id,
+		Rev:  NewRevision(curRev, doc),
+		Doc:  doc,
+		Keys: keys,
+	}, nil
+}
+
+// checkUnique fails with EConflict when a record other than next holds one
+// of its keys in a unique index. The records about to be written, in
+// pending, are taken in place of those stored.
+func (this *Table) checkUnique(next *Record, pending map[string]*Record) *ergo.Error {
+	for _, def := range this.defs {
+		if !def.Unique {
+			continue
+		}
+		for _, key := range next.Keys[def.Name] {
+			for id, record := range pending {
+				if id != next.Id && holds(record, def.Name, key) {
+					return NewError(EConflict, "id", next.Id, "index", def.Name, "key", key)
+				}
+			}
+			index := this.getIndex(def.Name)
+			if index == nil {
+				continue
+			}
+			value, ok := index.tree.Get(key)
+			if !ok {
+				continue
+			}
+			for _, record := range index.records(value, false) {
+				if _, ok := pending[record.Id]; !ok && record.Id != next.Id {
+					return NewError(EConflict, "id", next.Id, "index", def.Name, "key", key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func holds(record *Record, index, key string) bool {
+	for _, v := range record.Keys[index] {
+		if v == key {
+			return true
+		}
+	}
+	return false
+}
+
+func newTombstone(id, rev string) *Record {
+	return &Record{
+		Id:      id,
+		Rev:     NewRevision(rev, ""),
+		Doc:     "null",
+		Deleted: true,
+	}
+}
+
+// compact purges the tombstones that the database's policy no longer keeps,
+// oldest first. On failure, those already purged stay purged.
+func (this *Table) compact(now time.Time) (bool, *ergo.Error) {
+	if this.db == nil {
+		return false, nil
+	}
+	due := false
+	for this.tombs.Len() != 0 {
+		cur, _ := this.tombs.SeekFirst()
+		seq, mtime, _ := cur.Next()
+		if !this.db.policy.Expired(mtime.(time.Time), this.tombs.Len(), now) {
+			break
+		}
+		change, _ := this.changes.Get(seq)
+		id := change.(*Change).Id
+		more, kerr := this.log(&entry{Op: opPurge, Table: this.name, Record: &Record{Id: id}})
+		if kerr != nil {
+			return due, kerr
+		}
+		due = due || more
+		this.purge(id)
+	}
+	return due, nil
+}
+
+func (this *Table) log(e *entry) (bool, *ergo.Error) {
+	if this.db == nil {
+		return false, nil
+	}
+	return this.db.log(e)
+}
+
+// store replaces any existing record or tombstone with the same id.
+func (this *Table) store(record *Record, seq uint64) {
 	primary := this.getIndex("_id")
-	var record *Record
-	value, ok := primary.tree.Get(newRecord.Id)
+	value, ok := primary.tree.Get(record.Id)
 	if ok {
-		record = value.(*Record)
-		if newRecord.Rev != record.Rev {
-			return "", NewError(EConflict)
+		this.removeKeys(value.(*Record))
+		if value.(*Record).Deleted {
+			this.tombs.Delete(this.seqs[record.Id])
 		}
-		this.removeKeys(record)
-		record.Doc = doc
-		record.Keys = newRecord.Keys
-	} else {
-		record = newRecord
-		record.Doc = doc
-		primary.tree.Set(record.Id, record)
 	}
-	record.Rev = rev
+	primary.tree.Set(record.Id, record)
 	this.addKeys(record)
-	return rev, nil
+	this.changed(&Change{Seq: seq, Id: record.Id, Rev: record.Rev, Deleted: record.Deleted})
 }
 
-func (this *Table) Delete(id string) *ergo.Error {
-	this.mutex.Lock()
-	defer this.mutex.Unlock()
+// remove replaces a record with the tombstone tomb.
+func (this *Table) remove(tomb *Record, seq uint64, mtime time.Time) {
+	this.store(tomb, seq)
+	this.tombs.Set(seq, mtime)
+}
+
+// purge forgets a tombstone altogether, including its change.
+func (this *Table) purge(id string) {
 	primary := this.getIndex("_id")
-	raw, ok := primary.tree.Get(id)
-	if !ok {
-		return nil
+	value, ok := primary.tree.Get(id)
+	if !ok || !value.(*Record).Deleted {
+		return
 	}
-	record := raw.(*Record)
-	this.removeKeys(record)
 	primary.tree.Delete(id)
-	return nil
+	seq := this.seqs[id]
+	this.changes.Delete(seq)
+	this.tombs.Delete(seq)
+	delete(this.seqs, id)
 }
 
-func emit(query *Query, value interface{}, ch chan<- (*Record)) {
-	if query.Index == "_id" {
-		emit2(ch, value.(*Record))
-	} else {
-		node, ok := value.(*recordById)
-		if !ok {
-			panic("Downcast to recordById failed")
+// changed makes change the latest one for its record.
+func (this *Table) changed(change *Change) {
+	prev, ok := this.seqs[change.Id]
+	if ok {
+		this.changes.Delete(prev)
+	}
+	this.changes.Set(change.Seq, change)
+	this.seqs[change.Id] = change.Seq
+	if change.Seq > this.seq {
+		this.seq = change.Seq
+	}
+	close(this.watch)
+	this.watch = make(chan struct{})
+}
+
+func (this *Table) Watch(since uint64) (<-chan struct{}, *ergo.Error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.seq > since {
+		return closed, nil
+	}
+	return this.watch, nil
+}
+
+// replay applies a journaled put, delete, purge or batch of them.
+func (this *Table) replay(e *entry) {
+	switch e.Op {
+	case opPut:
+		this.store(e.Record, e.Seq)
+	case opDelete:
+		this.remove(e.Record, e.Seq, time.Unix(0, e.Time))
+	case opPurge:
+		this.purge(e.Record.Id)
+	case opIndex:
+		this.define(e.Index)
+	case opBatch:
+		for _, item := range e.Batch {
+			this.replay(item)
+		}
+	}
+}
+
+func (this *Table) Changes(ctx context.Context, since uint64) (chan (*Change), *ergo.Error) {
+	// the changes are copied first, so that the table is free while they
+	// wait to be received
+	this.mutex.RLock()
+	changes := []*Change{}
+	cur, _ := this.changes.Seek(since + 1)
+	for {
+		_, value, err := cur.Next()
+		if err == io.EOF {
+			break
 		}
-		for _, v := range node.records {
-			// fmt.Printf("emit: %v\n", v)
-			emit2(ch, v)
+		change := *value.(*Change)
+		changes = append(changes, &change)
+	}
+	this.mutex.RUnlock()
+	ch := make(chan (*Change))
+	go func() {
+		defer close(ch)
+		for _, change := range changes {
+			select {
+			case ch <- change:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+	return ch, nil
+}
+
+// export returns a copy of record, found under key, with its document
+// decoded.
+func export(key string, record *Record) *Record {
+	result := &Record{
+		Id:      record.Id,
+		Rev:     record.Rev,
+		Keys:    record.Keys,
+		Deleted: record.Deleted,
+		Cursor:  NewCursor(key, record.Id),
+	}
+	doc, kerr := driver.ExportDoc(record.Doc.(string))
+	if kerr != nil {
+		fmt.Printf("JSON decode failed: %v\n", kerr)
 	}
+	result.Doc = doc
+	return result
 }
 
-func emit2(ch chan<- (*Record), record *Record) {
-	result := &Record{Id: record.Id, Rev: record.Rev, Keys: record.Keys}
-	buf := bytes.NewBufferString(record.Doc.(string))
-	err := json.NewDecoder(buf).Decode(&result.Doc)
-	if err != nil {
-		fmt.Printf("JSON decode failed: %v\n", err)
+// records returns the records stored under a single index entry, ordered
+// by id so that enumeration follows (value, _id) order.
+func (this *Index) records(value interface{}, descending bool) []*Record {
+	if record, ok := value.(*Record); ok {
+		return []*Record{record}
+	}
+	node, ok := value.(*recordById)
+	if !ok {
+		panic("Downcast to recordById failed")
+	}
+	ids := make([]string, 0, len(node.records))
+	for id := range node.records {
+		ids = append(ids, id)
+	}
+	if descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	} else {
+		sort.Strings(ids)
+	}
+	records := make([]*Record, len(ids))
+	for i, id := range ids {
+		records[i] = node.records[id]
 	}
-	ch <- result
+	return records
 }
 
-func (this *Table) Get(query *Query) (chan (*Record), *ergo.Error) {
+func aboveUpper(upper Bound, key string) bool {
+	if !upper.IsDefined() {
+		return false
+	}
+	return key > upper.Value || (key == upper.Value && !upper.Inclusive)
+}
+
+func belowLower(lower Bound, key string) bool {
+	if !lower.IsDefined() {
+		return false
+	}
+	return key < lower.Value || (key == lower.Value && !lower.Inclusive)
+}
+
+func (this *Table) Get(ctx context.Context, query *Query) (chan (*Record), *ergo.Error) {
+	return driver.Stream(ctx, query, this.page)
+}
+
+// page reads up to query.Limit records, copied while holding the table's
+// lock.
+func (this *Table) page(query *Query) ([]*Record, bool, *ergo.Error) {
 	if query.Index == "" {
-		return nil, NewError(EBadIndex, "name", query.Index)
+		return nil, false, NewError(EBadIndex, "name", query.Index)
 	}
 	if query.Limit == 0 {
-		return nil, NewError(EBadParam, "name", "limit", "value", query.Limit)
+		return nil, false, NewError(EBadParam, "name", "limit", "value", query.Limit)
+	}
+	var afterKey, afterId string
+	if query.After != "" {
+		var kerr *ergo.Error
+		afterKey, afterId, kerr = ParseCursor(query.After)
+		if kerr != nil {
+			return nil, false, kerr
+		}
 	}
 	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.dropped {
+		return nil, false, NewError(EBadTable, "name", this.name)
+	}
 	index := this.getIndex(query.Index)
 	if index == nil {
-		this.mutex.RUnlock()
-		return nil, NewError(EBadIndex, "name", query.Index)
+		return nil, false, NewError(EBadIndex, "name", query.Index)
 	}
 	var cur *b.Enumerator
-	var hit bool
-	if query.Lower.IsDefined() {
-		cur, hit = index.tree.Seek(query.Lower.Value)
+	var start Bound
+	if query.Descending {
+		start = query.Upper
+	} else {
+		start = query.Lower
+	}
+	if query.After != "" {
+		cur, _ = index.tree.Seek(afterKey)
+	} else if start.IsDefined() {
+		cur, _ = index.tree.Seek(start.Value)
+	} else if query.Descending {
+		cur, _ = index.tree.SeekLast()
 	} else {
 		cur, _ = index.tree.SeekFirst()
 	}
-	end := index.findEnd(query.Upper)
-	ch := make(chan (*Record))
-	go func() {
-		// fmt.Printf("Query: (%v, %v)\n", query.Lower, query.Upper)
-		defer this.mutex.RUnlock()
-		defer close(ch)
-		if cur == nil {
-			ch <- nil
-			return
-		}
-		var count uint = 0
-		for {
-			key, value, err := cur.Next()
-			// fmt.Printf("Enumerating: [%d] %v %v\n", count, key, err)
-			if err == io.EOF || (end != nil && key == end.key) {
-				// fmt.Printf("EOF\n")
-				ch <- nil
-				return
-			}
-			if hit && key == query.Lower.Value && !query.Lower.Inclusive {
+	records := []*Record{}
+	if cur == nil {
+		return records, false, nil
+	}
+	next, past, before := cur.Next, aboveUpper, belowLower
+	end, begin := query.Upper, query.Lower
+	if query.Descending {
+		next, past, before = cur.Prev, belowLower, aboveUpper
+		end, begin = query.Lower, query.Upper
+	}
+	for {
+		raw, value, err := next()
+		if err == io.EOF {
+			return records, false, nil
+		}
+		key := raw.(string)
+		if past(end, key) {
+			return records, false, nil
+		}
+		if before(begin, key) {
+			continue
+		}
+		for _, record := range index.records(value, query.Descending) {
+			if record.Deleted && !query.Deleted {
 				continue
 			}
-			if count == query.Limit {
-				// fmt.Printf("Reached limit\n")
-				return
+			if query.After != "" && key == afterKey {
+				if !query.Descending && record.Id <= afterId {
+					continue
+				}
+				if query.Descending && record.Id >= afterId {
+					continue
+				}
+			}
+			if uint(len(records)) == query.Limit {
+				return records, true, nil
 			}
-			emit(query, value, ch)
-			count++
+			records = append(records, export(key, record))
 		}
-	}()
-	return ch, nil
+	}
 }
 
-func (this *Table) getIndex(name string) *Index {
-	index, ok := this.keys[name]
+// lookup returns the record or tombstone stored under id, if any.
+func (this *Table) lookup(id string) *Record {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	value, ok := this.getIndex("_id").tree.Get(id)
 	if !ok {
 		return nil
 	}
-	return index
+	return value.(*Record)
 }
 
-func (this *Index) findEnd(upper Bound) *sentinel {
-	if !upper.IsDefined() {
-		return nil
+func (this *Table) ListIndexes() ([]string, *ergo.Error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	names := []string{}
+	for name, index := range this.keys {
+		if name == "_id" || index.tree.Len() > 0 || this.findDef(name) != nil {
+			names = append(names, name)
+		}
 	}
-	cursor, hit := this.tree.Seek(upper.Value)
-	for {
-		key, _, err := cursor.Next()
-		if err == io.EOF {
-			return nil
+	sort.Strings(names)
+	return names, nil
+}
+
+func (this *Table) ListIndexDefs() ([]*IndexDef, *ergo.Error) {
+	defs := this.indexDefs()
+	if defs == nil {
+		defs = []*IndexDef{}
+	}
+	return defs, nil
+}
+
+func (this *Table) indexDefs() []*IndexDef {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.defs
+}
+
+func (this *Table) findDef(name string) *IndexDef {
+	for _, def := range this.defs {
+		if def.Name == name {
+			return def
 		}
-		if !hit || !upper.Inclusive {
-			return &sentinel{key.(string)}
+	}
+	return nil
+}
+
+func (this *Table) DefineIndex(def *IndexDef) *ergo.Error {
+	kerr := def.Validate()
+	if kerr != nil {
+		return kerr
+	}
+	stored := *def
+	e := &entry{Op: opIndex, Table: this.name, Index: &stored}
+	this.mutex.Lock()
+	var due bool
+	if this.dropped {
+		kerr = NewError(EBadTable, "name", this.name)
+	} else if def.Unique {
+		kerr = this.checkKeys(def)
+	}
+	if kerr == nil {
+		due, kerr = this.log(e)
+	}
+	if kerr == nil {
+		this.replay(e)
+	}
+	this.mutex.Unlock()
+	if kerr != nil {
+		return kerr
+	}
+	if due {
+		return this.db.checkpoint()
+	}
+	return nil
+}
+
+// define replaces the definition of an index and computes its keys for
+// every record.
+func (this *Table) define(def *IndexDef) {
+	defs := []*IndexDef{def}
+	for _, other := range this.defs {
+		if other.Name != def.Name {
+			defs = append(defs, other)
+		}
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	this.defs = defs
+	if this.getIndex(def.Name) == nil {
+		this.keys[def.Name] = newIndex(def.Name)
+	}
+	primary := this.getIndex("_id")
+	for _, record := range this.live() {
+		keys, kerr := driver.ComputeKeys([]*IndexDef{def}, record.Keys, record.Doc.(string))
+		if kerr != nil {
+			continue
+		}
+		// readers may hold on to the old record, so it is replaced
+		this.removeKeys(record)
+		next := *record
+		next.Keys = keys
+		primary.tree.Set(next.Id, &next)
+		this.addKeys(&next)
+	}
+}
+
+// checkKeys fails with EConflict when two records would share a key of the
+// unique index def.
+func (this *Table) checkKeys(def *IndexDef) *ergo.Error {
+	holders := make(map[string]bool)
+	for _, record := range this.live() {
+		keys, kerr := driver.ComputeKeys([]*IndexDef{def}, nil, record.Doc.(string))
+		if kerr != nil {
+			continue
+		}
+		for _, key := range keys[def.Name] {
+			if holders[key] {
+				return NewError(EConflict, "id", record.Id, "index", def.Name, "key", key)
+			}
+			holders[key] = true
 		}
-		if key != upper.Value {
-			return &sentinel{key.(string)}
+	}
+	return nil
+}
+
+// live returns the stored records, leaving out tombstones.
+func (this *Table) live() []*Record {
+	records := []*Record{}
+	cur, err := this.getIndex("_id").tree.SeekFirst()
+	for err == nil {
+		var value interface{}
+		_, value, err = cur.Next()
+		if err == nil && !value.(*Record).Deleted {
+			records = append(records, value.(*Record))
 		}
 	}
+	return records
+}
+
+func (this *Table) getIndex(name string) *Index {
+	index, ok := this.keys[name]
+	if !ok {
+		return nil
+	}
+	return index
 }
 
 func (this *Index) add(key string, record *Record) {
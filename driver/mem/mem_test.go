@@ -1,18 +1,431 @@
 package mem
 
 import (
+	"context"
+	. "github.com/flaub/kissdif"
 	"github.com/flaub/kissdif/driver/test"
 	. "github.com/motain/gocheck"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 type TestDriver struct {
 	*test.TestSuite
 }
 
+type TestDurable struct {
+	*test.TestSuite
+}
+
+type TestJournal struct {
+	dir string
+}
+
 // Hook up gocheck into the "go test" runner.
 func Test(t *testing.T) { TestingT(t) }
 
 func init() {
 	Suite(&TestDriver{TestSuite: test.NewTestSuite("mem")})
+	Suite(&TestDurable{TestSuite: test.NewTestSuite("mem")})
+	Suite(&TestJournal{})
+}
+
+func (this *TestDurable) SetUpTest(c *C) {
+	this.Config = Dictionary{"dir": c.MkDir(), "snapshot": "3"}
+	this.TestSuite.SetUpTest(c)
+}
+
+// TestCompaction opens a second database with the suite's config, which
+// mustn't share the first one's journal.
+func (this *TestDurable) TestCompaction(c *C) {
+	this.Config["dir"] = c.MkDir()
+	this.TestSuite.TestCompaction(c)
+}
+
+func (this *TestDurable) TestCompactionTTL(c *C) {
+	this.Config["dir"] = c.MkDir()
+	this.TestSuite.TestCompactionTTL(c)
+}
+
+// TestReopenAfterPurge checks that sequences aren't reused once the newest
+// changes, being tombstones, are purged and a snapshot is taken.
+func (this *TestDurable) TestReopenAfterPurge(c *C) {
+	config := Dictionary{"dir": c.MkDir(), "snapshot": "1", "tombstone_ttl": "50ms"}
+	db, err := NewDriver().Configure("db", config)
+	c.Assert(err, IsNil)
+	table, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	_, err = table.Put(&Record{Id: "1", Doc: "1"})
+	c.Assert(err, IsNil)
+	rev, err := table.Put(&Record{Id: "2", Doc: "2"})
+	c.Assert(err, IsNil)
+	_, err = table.Delete("2", rev)
+	c.Assert(err, IsNil)
+	c.Assert(db.Close(), IsNil)
+	time.Sleep(100 * time.Millisecond)
+
+	// opening purges the tombstone and takes a snapshot without it
+	db, err = NewDriver().Configure("db", config)
+	c.Assert(err, IsNil)
+	c.Assert(db.Close(), IsNil)
+	db, err = NewDriver().Configure("db", config)
+	c.Assert(err, IsNil)
+	table, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	rev, err = table.Put(&Record{Id: "3", Doc: "3"})
+	c.Assert(err, IsNil)
+	ch, err := table.Changes(context.Background(), 3)
+	c.Assert(err, IsNil)
+	changes := []Change{}
+	for change := range ch {
+		changes = append(changes, *change)
+	}
+	c.Check(changes, DeepEquals, []Change{{Seq: 4, Id: "3", Rev: rev}})
+}
+
+// TestTxConflict checks that a transaction's writes are checked again when
+// it commits.
+func (this *TestDriver) TestTxConflict(c *C) {
+	db, err := NewDriver().Configure("db", Dictionary{})
+	c.Assert(err, IsNil)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	rev, err := a.Put(&Record{Id: "1", Doc: "1"})
+	c.Assert(err, IsNil)
+
+	tx, err := db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Put("b", &Record{Id: "1", Doc: "1"})
+	c.Assert(err, IsNil)
+	_, err = tx.Put("a", &Record{Id: "1", Rev: rev, Doc: "2"})
+	c.Assert(err, IsNil)
+	_, err = a.Put(&Record{Id: "1", Rev: rev, Doc: "3"})
+	c.Assert(err, IsNil)
+	err = tx.Commit()
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+
+	names, err := db.ListTables()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"a"})
+}
+
+func (this *TestJournal) SetUpTest(c *C) {
+	this.dir = c.MkDir()
+}
+
+func (this *TestJournal) open(c *C) *Database {
+	db, err := NewDriver().Configure("db", Dictionary{"dir": this.dir, "snapshot": "4"})
+	c.Assert(err, IsNil)
+	return db.(*Database)
+}
+
+func (this *TestJournal) put(c *C, table *Table, id, rev string, keys IndexMap) string {
+	rev, err := table.Put(&Record{Id: id, Rev: rev, Doc: id, Keys: keys})
+	c.Assert(err, IsNil)
+	return rev
+}
+
+func (this *TestJournal) ids(c *C, table *Table, index string) []string {
+	ch, err := table.Get(context.Background(), &Query{Index: index, Limit: 100})
+	c.Assert(err, IsNil)
+	ids := []string{}
+	for record := range ch {
+		if record != nil {
+			ids = append(ids, record.Id)
+		}
+	}
+	return ids
+}
+
+func (this *TestJournal) TestReopen(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	this.put(c, a, "1", "", IndexMap{"name": {"x"}})
+	rev := this.put(c, a, "2", "", IndexMap{"name": {"y"}})
+	this.put(c, a, "3", "", nil)
+	tomb, err := a.Delete("2", rev)
+	c.Assert(err, IsNil)
+	_, err = db.GetTable("b", true)
+	c.Assert(err, IsNil)
+	_, err = db.GetTable("c", true)
+	c.Assert(err, IsNil)
+	c.Assert(db.DropTable("c"), IsNil)
+
+	// the first snapshot was taken after four entries
+	_, serr := os.Stat(filepath.Join(this.dir, snapshotFile))
+	c.Assert(serr, IsNil)
+
+	db = this.open(c)
+	names, err := db.ListTables()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"a", "b"})
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	a = raw.(*Table)
+	c.Check(this.ids(c, a, "_id"), DeepEquals, []string{"1", "3"})
+	c.Check(this.ids(c, a, "name"), DeepEquals, []string{"1"})
+
+	ch, err := a.Changes(context.Background(), 0)
+	c.Assert(err, IsNil)
+	changes := []Change{}
+	for change := range ch {
+		changes = append(changes, *change)
+	}
+	c.Assert(changes, HasLen, 3)
+	c.Check(changes[0].Seq, Equals, uint64(1))
+	c.Check(changes[1].Seq, Equals, uint64(3))
+	c.Check(changes[2], Equals, Change{Seq: 4, Id: "2", Rev: tomb, Deleted: true})
+
+	// revisions survive, so updates still require the current one
+	_, err = a.Put(&Record{Id: "1", Doc: "1"})
+	c.Check(err, NotNil)
+}
+
+func (this *TestJournal) TestBatch(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	rev := this.put(c, a, "1", "", nil)
+	results, err := a.PutMany([]*Record{
+		{Id: "2", Doc: "2", Keys: IndexMap{"name": {"x"}}},
+		{Id: "1", Rev: rev, Deleted: true},
+	}, true)
+	c.Assert(err, IsNil)
+
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	a = raw.(*Table)
+	c.Check(this.ids(c, a, "_id"), DeepEquals, []string{"2"})
+	c.Check(this.ids(c, a, "name"), DeepEquals, []string{"2"})
+	ch, err := a.Changes(context.Background(), 1)
+	c.Assert(err, IsNil)
+	changes := []Change{}
+	for change := range ch {
+		changes = append(changes, *change)
+	}
+	c.Check(changes, DeepEquals, []Change{
+		{Seq: 2, Id: "2", Rev: results[0].Rev},
+		{Seq: 3, Id: "1", Rev: results[1].Rev, Deleted: true},
+	})
+}
+
+func (this *TestJournal) TestTx(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	rev := this.put(c, raw.(*Table), "1", "", nil)
+	tx, err := db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Delete("a", "1", rev)
+	c.Assert(err, IsNil)
+	_, err = tx.Put("b", &Record{Id: "2", Doc: "2"})
+	c.Assert(err, IsNil)
+	c.Assert(tx.Commit(), IsNil)
+
+	db = this.open(c)
+	names, err := db.ListTables()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"a", "b"})
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	c.Check(this.ids(c, raw.(*Table), "_id"), DeepEquals, []string{})
+	raw, err = db.GetTable("b", false)
+	c.Assert(err, IsNil)
+	c.Check(this.ids(c, raw.(*Table), "_id"), DeepEquals, []string{"2"})
+}
+
+func (this *TestJournal) TestTornWrite(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	this.put(c, raw.(*Table), "1", "", nil)
+
+	path := filepath.Join(this.dir, walFile)
+	file, oerr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(oerr, IsNil)
+	_, oerr = file.WriteString(`{"Op":"put","Table":"a","Rec`)
+	c.Assert(oerr, IsNil)
+	file.Close()
+
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	this.put(c, raw.(*Table), "2", "", nil)
+
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	c.Check(this.ids(c, raw.(*Table), "_id"), DeepEquals, []string{"1", "2"})
+}
+
+func (this *TestJournal) TestCorrupt(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	this.put(c, raw.(*Table), "1", "", nil)
+
+	// a bad last entry was torn by a crash, and is dropped
+	path := filepath.Join(this.dir, walFile)
+	file, oerr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(oerr, IsNil)
+	_, oerr = file.WriteString("\x00\x00\x00\n")
+	c.Assert(oerr, IsNil)
+	file.Close()
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	this.put(c, raw.(*Table), "2", "", nil)
+
+	// but one followed by others means the log is corrupt, and is kept
+	good, oerr := ioutil.ReadFile(path)
+	c.Assert(oerr, IsNil)
+	c.Assert(ioutil.WriteFile(path, append([]byte("{\n"), good...), 0644), IsNil)
+	_, err = NewDriver().Configure("db", Dictionary{"dir": this.dir, "snapshot": "4"})
+	c.Check(err, NotNil)
+	kept, oerr := ioutil.ReadFile(path)
+	c.Assert(oerr, IsNil)
+	c.Check(len(kept), Equals, len(good)+2)
+
+	// the same goes for the snapshot
+	c.Assert(ioutil.WriteFile(path, good, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(this.dir, snapshotFile), []byte("{\n{}\n"), 0644), IsNil)
+	_, err = NewDriver().Configure("db", Dictionary{"dir": this.dir, "snapshot": "4"})
+	c.Check(err, NotNil)
+}
+
+func (this *TestJournal) TestFailedAppend(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	this.put(c, a, "1", "", nil)
+
+	// part of an entry that failed to be written is cut off again
+	_, oerr := db.journal.wal.WriteString(`{"Op":"put","Table":"a","Rec`)
+	c.Assert(oerr, IsNil)
+	db.journal.rewind()
+	this.put(c, a, "2", "", nil)
+
+	// and if it can't be, the journal refuses any more writes
+	path := filepath.Join(this.dir, walFile)
+	db.journal.wal.Close()
+	db.journal.wal, oerr = os.Open(path)
+	c.Assert(oerr, IsNil)
+	_, err = a.Put(&Record{Id: "3", Doc: "3"})
+	c.Check(err, NotNil)
+	c.Check(db.journal.failed, NotNil)
+	_, err = a.Put(&Record{Id: "4", Doc: "4"})
+	c.Check(err, NotNil)
+
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	c.Check(this.ids(c, raw.(*Table), "_id"), DeepEquals, []string{"1", "2"})
+}
+
+func (this *TestJournal) TestSnapshotFailed(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	tmp := filepath.Join(this.dir, snapshotFile+".tmp")
+	c.Assert(os.Mkdir(tmp, 0755), IsNil)
+	this.put(c, a, "1", "", nil)
+	this.put(c, a, "2", "", nil)
+	_, err = a.Put(&Record{Id: "3", Doc: "3"})
+	c.Check(err, NotNil)
+
+	// the log still holds every write, and the next one snapshots them
+	c.Assert(os.Remove(tmp), IsNil)
+	this.put(c, a, "4", "", nil)
+	_, serr := os.Stat(filepath.Join(this.dir, snapshotFile))
+	c.Check(serr, IsNil)
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	c.Check(this.ids(c, raw.(*Table), "_id"), DeepEquals, []string{"1", "2", "3", "4"})
+}
+
+func (this *TestJournal) TestDropTable(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	c.Assert(db.DropTable("a"), IsNil)
+	_, err = a.Put(&Record{Id: "1", Doc: "1"})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadTable)
+	c.Check(a.DefineIndex(&IndexDef{Name: "x", Path: "/x"}).Code, Equals, EBadTable)
+	_, err = a.Get(context.Background(), &Query{Index: "_id", Limit: 100})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadTable)
+
+	db = this.open(c)
+	names, err := db.ListTables()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{})
+}
+
+func (this *TestJournal) TestClose(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	this.put(c, a, "1", "", nil)
+	c.Assert(db.Close(), IsNil)
+	_, err = a.Put(&Record{Id: "2", Doc: "2"})
+	c.Check(err, NotNil)
+
+	db = this.open(c)
+	raw, err = db.GetTable("a", false)
+	c.Assert(err, IsNil)
+	c.Check(this.ids(c, raw.(*Table), "_id"), DeepEquals, []string{"1"})
+}
+
+func (this *TestJournal) TestDrop(c *C) {
+	db := this.open(c)
+	_, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	c.Assert(db.Drop(), IsNil)
+	files, _ := ioutil.ReadDir(this.dir)
+	c.Check(files, HasLen, 0)
+}
+
+func (this *TestJournal) TestIndexDef(c *C) {
+	db := this.open(c)
+	raw, err := db.GetTable("a", true)
+	c.Assert(err, IsNil)
+	a := raw.(*Table)
+	_, err = a.Put(&Record{Id: "1", Doc: map[string]interface{}{"name": "x"}})
+	c.Assert(err, IsNil)
+	c.Assert(a.DefineIndex(&IndexDef{Name: "name", Path: "/name"}), IsNil)
+	_, err = a.Put(&Record{Id: "2", Doc: map[string]interface{}{"name": "y"}})
+	c.Assert(err, IsNil)
+
+	// the definition is taken into the first snapshot, after four entries,
+	// and replayed from it along with the log
+	ids := []string{"1", "2"}
+	for _, id := range []string{"3", "4"} {
+		db = this.open(c)
+		raw, err = db.GetTable("a", false)
+		c.Assert(err, IsNil)
+		a = raw.(*Table)
+		c.Check(this.ids(c, a, "name"), DeepEquals, ids)
+		_, err = a.Put(&Record{Id: id, Doc: map[string]interface{}{"name": "z"}})
+		c.Assert(err, IsNil)
+		ids = append(ids, id)
+		defs, err := a.ListIndexDefs()
+		c.Assert(err, IsNil)
+		c.Check(defs, DeepEquals, []*IndexDef{{Name: "name", Path: "/name"}})
+	}
+	c.Check(this.ids(c, a, "name"), DeepEquals, ids)
 }
@@ -0,0 +1,386 @@
+package mem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/flaub/ergo"
+	. "github.com/flaub/kissdif"
+	"github.com/flaub/kissdif/driver"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tx keeps a transaction's writes to itself until Commit, which checks
+// that each of them still applies to what is stored and then applies them
+// all while holding the locks of the tables involved.
+type Tx struct {
+	db      *Database
+	writes  []*txWrite
+	pending map[txKey]*Record // latest write to each record
+	done    bool
+	mutex   sync.Mutex
+}
+
+type txKey struct {
+	table, id string
+}
+
+// txWrite is a write along with the record or tombstone it stores, which
+// is nil when there is nothing to do.
+type txWrite struct {
+	table  string
+	record Record
+	doc    string
+	next   *Record
+}
+
+// txHit is a record found by a query within a transaction, along with the
+// index value it was found under.
+type txHit struct {
+	key    string
+	record *Record
+}
+
+type txHits struct {
+	hits       []txHit
+	descending bool
+}
+
+func (this *Database) Begin() (driver.Tx, *ergo.Error) {
+	return &Tx{db: this, pending: make(map[txKey]*Record)}, nil
+}
+
+func (this *Tx) Put(table string, record *Record) (string, *ergo.Error) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(record.Doc)
+	if err != nil {
+		return "", Wrap(err)
+	}
+	rev, kerr := this.write(table, record, buf.String())
+	if kerr != nil {
+		return "", kerr
+	}
+	record.Rev = rev
+	return rev, nil
+}
+
+func (this *Tx) Delete(table, id, rev string) (string, *ergo.Error) {
+	return this.write(table, &Record{Id: id, Rev: rev, Deleted: true}, "")
+}
+
+func (this *Tx) write(table string, record *Record, doc string) (string, *ergo.Error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return "", NewError(EBadTx)
+	}
+	if record.Deleted && this.table(table) == nil && !this.creates(table) {
+		return "", NewError(EBadTable, "name", table)
+	}
+	key := txKey{table, record.Id}
+	cur, ok := this.pending[key]
+	if !ok {
+		cur = this.stored(table, record.Id)
+	}
+	var defs []*IndexDef
+	if stored := this.table(table); stored != nil {
+		defs = stored.indexDefs()
+	}
+	next, kerr := plan(record, doc, cur, defs)
+	if kerr != nil {
+		return "", kerr
+	}
+	this.writes = append(this.writes, &txWrite{table: table, record: *record, doc: doc, next: next})
+	if next == nil {
+		return "", nil
+	}
+	this.pending[key] = next
+	return next.Rev, nil
+}
+
+func (this *Tx) table(name string) *Table {
+	this.db.mutex.RLock()
+	defer this.db.mutex.RUnlock()
+	return this.db.tables[name]
+}
+
+// creates reports whether the transaction puts a record in the table.
+func (this *Tx) creates(name string) bool {
+	for key, record := range this.pending {
+		if key.table == name && !record.Deleted {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Tx) stored(name, id string) *Record {
+	table := this.table(name)
+	if table == nil {
+		return nil
+	}
+	return table.lookup(id)
+}
+
+// Get runs the query against the stored records, leaving out those the
+// transaction has written, and merges in the transaction's own records.
+func (this *Tx) Get(ctx context.Context, name string, query *Query) (chan (*Record), *ergo.Error) {
+	if query.Index == "" {
+		return nil, NewError(EBadIndex, "name", query.Index)
+	}
+	if query.Limit == 0 {
+		return nil, NewError(EBadParam, "name", "limit", "value", query.Limit)
+	}
+	var afterKey, afterId string
+	if query.After != "" {
+		var kerr *ergo.Error
+		afterKey, afterId, kerr = ParseCursor(query.After)
+		if kerr != nil {
+			return nil, kerr
+		}
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return nil, NewError(EBadTx)
+	}
+	pending := []*Record{}
+	for key, record := range this.pending {
+		if key.table == name {
+			pending = append(pending, record)
+		}
+	}
+	table := this.table(name)
+	if table == nil && len(pending) == 0 {
+		return nil, NewError(EBadTable, "name", name)
+	}
+	result := txHits{descending: query.Descending}
+	eof := true
+	if table != nil {
+		// each record written may hide stored entries from the query
+		base := *query
+		for _, record := range pending {
+			stored := table.lookup(record.Id)
+			if stored == nil {
+				continue
+			}
+			if query.Index == "_id" {
+				base.Limit++
+			} else {
+				base.Limit += uint(len(stored.Keys[query.Index]))
+			}
+		}
+		ctx, failure := driver.WithFailure(ctx)
+		ch, kerr := table.Get(ctx, &base)
+		if kerr != nil && (kerr.Code != EBadIndex || len(pending) == 0) {
+			return nil, kerr
+		}
+		if kerr == nil {
+			eof = false
+			for record := range ch {
+				if record == nil {
+					eof = true
+					continue
+				}
+				_, ok := this.pending[txKey{name, record.Id}]
+				if !ok {
+					key, _, _ := ParseCursor(record.Cursor)
+					result.hits = append(result.hits, txHit{key, record})
+				}
+			}
+			if failure.Err() != nil {
+				return nil, failure.Err()
+			}
+		}
+	}
+	for _, record := range pending {
+		if record.Deleted && !query.Deleted {
+			continue
+		}
+		keys := record.Keys[query.Index]
+		if query.Index == "_id" {
+			keys = []string{record.Id}
+		}
+		for _, key := range keys {
+			if belowLower(query.Lower, key) || aboveUpper(query.Upper, key) {
+				continue
+			}
+			if query.After != "" && !after(key, record.Id, afterKey, afterId, query.Descending) {
+				continue
+			}
+			result.hits = append(result.hits, txHit{key, export(key, record)})
+		}
+	}
+	sort.Sort(&result)
+	ch := make(chan (*Record), len(result.hits)+1)
+	for i, hit := range result.hits {
+		if uint(i) == query.Limit {
+			break
+		}
+		ch <- hit.record
+	}
+	if eof && uint(len(result.hits)) <= query.Limit {
+		ch <- nil
+	}
+	close(ch)
+	return ch, nil
+}
+
+// after reports whether the entry for id under key comes after the one for
+// afterId under afterKey.
+func after(key, id, afterKey, afterId string, descending bool) bool {
+	if descending {
+		return key < afterKey || (key == afterKey && id < afterId)
+	}
+	return key > afterKey || (key == afterKey && id > afterId)
+}
+
+func (this *txHits) Len() int {
+	return len(this.hits)
+}
+
+func (this *txHits) Swap(i, j int) {
+	this.hits[i], this.hits[j] = this.hits[j], this.hits[i]
+}
+
+func (this *txHits) Less(i, j int) bool {
+	a, b := this.hits[i], this.hits[j]
+	if this.descending {
+		a, b = b, a
+	}
+	return a.key < b.key || (a.key == b.key && a.record.Id < b.record.Id)
+}
+
+func (this *Tx) Commit() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return NewError(EBadTx)
+	}
+	this.done = true
+	due, kerr := this.db.commit(this.writes)
+	if kerr != nil {
+		return kerr
+	}
+	if due {
+		return this.db.checkpoint()
+	}
+	return nil
+}
+
+func (this *Tx) Rollback() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return NewError(EBadTx)
+	}
+	this.done = true
+	return nil
+}
+
+// commit checks that every write still stores what it did when it was
+// made, then journals them as one entry and applies them. Tables are
+// locked in name order, as checkpoint does.
+func (this *Database) commit(writes []*txWrite) (bool, *ergo.Error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	names := []string{}
+	tables := make(map[string]*Table)
+	seqs := make(map[string]uint64)
+	for _, w := range writes {
+		if _, ok := tables[w.table]; ok {
+			continue
+		}
+		table, ok := this.tables[w.table]
+		if !ok {
+			table = NewTable(w.table)
+			table.db = this
+		}
+		tables[w.table] = table
+		seqs[w.table] = table.seq
+		names = append(names, w.table)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table := tables[name]
+		table.mutex.Lock()
+		defer table.mutex.Unlock()
+	}
+	now := time.Now()
+	pending := make(map[string]map[string]*Record) // by table, then id
+	batch := []*entry{}
+	for _, w := range writes {
+		written, ok := pending[w.table]
+		if !ok {
+			written = make(map[string]*Record)
+			pending[w.table] = written
+		}
+		cur, ok := written[w.record.Id]
+		if !ok {
+			value, ok := tables[w.table].getIndex("_id").tree.Get(w.record.Id)
+			if ok {
+				cur = value.(*Record)
+			}
+		}
+		next, kerr := plan(&w.record, w.doc, cur, tables[w.table].defs)
+		if kerr != nil {
+			return false, kerr
+		}
+		if (next == nil) != (w.next == nil) || (next != nil && next.Rev != w.next.Rev) {
+			return false, NewError(EConflict, "id", w.record.Id)
+		}
+		if next == nil {
+			continue
+		}
+		kerr = tables[w.table].checkUnique(next, written)
+		if kerr != nil {
+			return false, kerr
+		}
+		written[w.record.Id] = next
+		seqs[w.table]++
+		e := &entry{Op: opPut, Table: w.table, Record: next, Seq: seqs[w.table]}
+		if next.Deleted {
+			e.Op = opDelete
+			e.Time = now.UnixNano()
+		}
+		batch = append(batch, e)
+	}
+	if len(batch) == 0 {
+		return false, nil
+	}
+	created := []*entry{}
+	for _, name := range names {
+		_, ok := this.tables[name]
+		if !ok && seqs[name] != 0 {
+			created = append(created, &entry{Op: opCreate, Table: name})
+		}
+	}
+	batch = append(created, batch...)
+	e := batch[0]
+	if len(batch) > 1 {
+		e = &entry{Op: opBatch, Batch: batch}
+	}
+	due, kerr := this.log(e)
+	if kerr != nil {
+		return false, kerr
+	}
+	for _, item := range batch {
+		if item.Op == opCreate {
+			this.tables[item.Table] = tables[item.Table]
+		} else {
+			tables[item.Table].replay(item)
+		}
+	}
+	for _, name := range names {
+		more, kerr := tables[name].compact(now)
+		if kerr != nil {
+			// the writes are made, and the purge is tried again by the next one
+			fmt.Printf("Purging tombstones failed: %v\n", kerr)
+		}
+		due = due || more
+	}
+	return due, nil
+}
@@ -0,0 +1,126 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the tables of a database created by an older version
+// of this driver. Each one is applied to every table in turn, and the
+// number applied so far is kept in the database's user_version.
+var migrations = []string{
+	// 1: _id and _rev were declared INT, so numeric looking ids were
+	// coerced and "01" collided with "1". The changes feed starts with
+	// every existing record.
+	`
+DROP INDEX IF EXISTS I_Alt_{{.T}}_value;
+DROP INDEX IF EXISTS I_Alt_{{.T}}_id;
+ALTER TABLE T_Main_{{.T}} RENAME TO T_Old_Main_{{.T}};
+ALTER TABLE T_Alt_{{.T}} RENAME TO T_Old_Alt_{{.T}};
+
+CREATE TABLE T_Main_{{.T}} (
+	_id TEXT NOT NULL,
+	_rev TEXT NOT NULL,
+	doc TEXT NOT NULL,
+	_deleted INT NOT NULL DEFAULT 0,
+	_mtime INT NOT NULL DEFAULT 0,
+	PRIMARY KEY(_id)
+);
+
+CREATE TABLE T_Alt_{{.T}} (
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	_id TEXT NOT NULL,
+	PRIMARY KEY(name, value, _id)
+);
+
+CREATE INDEX I_Alt_{{.T}}_value ON T_Alt_{{.T}} (value);
+CREATE INDEX I_Alt_{{.T}}_id ON T_Alt_{{.T}} (_id);
+
+CREATE TABLE T_Seq_{{.T}} (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	_id TEXT NOT NULL UNIQUE,
+	_rev TEXT NOT NULL,
+	deleted INT NOT NULL DEFAULT 0
+);
+
+INSERT INTO T_Main_{{.T}} (_id, _rev, doc)
+	SELECT CAST(_id AS TEXT), CAST(_rev AS TEXT), doc FROM T_Old_Main_{{.T}};
+INSERT OR IGNORE INTO T_Alt_{{.T}}
+	SELECT name, value, CAST(_id AS TEXT) FROM T_Old_Alt_{{.T}};
+INSERT INTO T_Seq_{{.T}} (_id, _rev)
+	SELECT _id, _rev FROM T_Main_{{.T}} ORDER BY _id;
+
+DROP TABLE T_Old_Main_{{.T}};
+DROP TABLE T_Old_Alt_{{.T}};
+`,
+}
+
+const sqlTableList = `
+SELECT substr(name, 8) FROM sqlite_master
+WHERE type = 'table' AND name LIKE 'T\_Main\_%' ESCAPE '\'
+ORDER BY name
+`
+
+// listTables returns the names of the tables found in db.
+func listTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(sqlTableList)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// migrate brings every table in db up to the current schema version.
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version >= len(migrations) {
+		return nil
+	}
+	names, err := listTables(db)
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		err = upgrade(db, names, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upgrade(db *sql.DB, names []string, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	ref := referee{tx: tx}
+	defer ref.Close()
+	for _, name := range names {
+		_, err = tx.Exec(compile(migrations[version], name, ""))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+	if err != nil {
+		return err
+	}
+	ref.ok = true
+	return nil
+}
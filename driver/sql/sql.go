@@ -2,72 +2,144 @@ package sql
 
 import (
 	"bytes"
-	_ "code.google.com/p/go-sqlite/go1/sqlite3"
-	"crypto/sha1"
+	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"github.com/flaub/ergo"
 	. "github.com/flaub/kissdif"
 	"github.com/flaub/kissdif/driver"
-	"io"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 )
 
 const (
 	sqlSchema = `
 CREATE TABLE IF NOT EXISTS T_Main_{{.T}} (
-	_id INT NOT NULL,
-	_rev INT NOT NULL,
+	_id TEXT NOT NULL,
+	_rev TEXT NOT NULL,
 	doc TEXT NOT NULL,
+	_deleted INT NOT NULL DEFAULT 0,
+	_mtime INT NOT NULL DEFAULT 0,
 	PRIMARY KEY(_id)
 );
 
 CREATE TABLE IF NOT EXISTS T_Alt_{{.T}} (
 	name TEXT NOT NULL,
 	value TEXT NOT NULL,
-	_id INT NOT NULL,
+	_id TEXT NOT NULL,
 	PRIMARY KEY(name, value, _id)
 );
 
 CREATE INDEX IF NOT EXISTS I_Alt_{{.T}}_value ON T_Alt_{{.T}} (value);
 CREATE INDEX IF NOT EXISTS I_Alt_{{.T}}_id ON T_Alt_{{.T}} (_id);
+CREATE INDEX IF NOT EXISTS I_Main_{{.T}}_deleted ON T_Main_{{.T}} (_deleted, _mtime);
+
+CREATE TABLE IF NOT EXISTS T_Seq_{{.T}} (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	_id TEXT NOT NULL UNIQUE,
+	_rev TEXT NOT NULL,
+	deleted INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS T_Def_{{.T}} (
+	name TEXT NOT NULL,
+	def TEXT NOT NULL,
+	PRIMARY KEY(name)
+);
+`
+	sqlDropSchema = `
+DROP INDEX IF EXISTS I_Alt_{{.T}}_value;
+DROP INDEX IF EXISTS I_Alt_{{.T}}_id;
+DROP INDEX IF EXISTS I_Main_{{.T}}_deleted;
+DROP TABLE IF EXISTS T_Alt_{{.T}};
+DROP TABLE IF EXISTS T_Main_{{.T}};
+DROP TABLE IF EXISTS T_Seq_{{.T}};
+DROP TABLE IF EXISTS T_Def_{{.T}};
 `
 	sqlRecordQuery = `
 SELECT
-	_id, _rev, doc
+	_id, _id, _rev, doc, _deleted
 FROM
 	T_Main_{{.T}}{{.W}}
 ORDER BY
-	_id
+	_id{{.O}}
 LIMIT ?
 `
 	sqlIndexQuery = `
 SELECT
-	r._id, r._rev, r.doc
+	i.value, r._id, r._rev, r.doc, r._deleted
 FROM
 	T_Main_{{.T}} r
 JOIN
 	T_Alt_{{.T}} i
 	USING(_id){{.W}}
 ORDER BY
-	i.value
+	i.value{{.O}}, i._id{{.O}}
 LIMIT ?
 `
+	sqlIndexList    = "SELECT name FROM T_Alt_{{.T}} UNION SELECT name FROM T_Def_{{.T}} ORDER BY name"
 	sqlRecordInsert = "INSERT INTO T_Main_{{.T}} (_id, _rev, doc) VALUES (?, ?, ?)"
 	sqlRecordUpdate = `
 UPDATE T_Main_{{.T}} 
-SET _rev = ?, doc = ?
+SET _rev = ?, doc = ?, _deleted = 0
 WHERE _id = ? AND _rev = ?
+`
+	sqlRecordDelete = `
+UPDATE T_Main_{{.T}}
+SET _rev = ?, doc = 'null', _deleted = 1, _mtime = ?
+WHERE _id = ? AND _rev = ? AND _deleted = 0
+`
+	sqlTombstonePurge = `
+DELETE FROM T_Main_{{.T}}
+WHERE _deleted = 1 AND (_mtime < ? OR _id NOT IN (
+	SELECT _id FROM T_Main_{{.T}} WHERE _deleted = 1 ORDER BY _mtime DESC, _id LIMIT ?
+))
+`
+	sqlChangePurge = `
+DELETE FROM T_Seq_{{.T}}
+WHERE deleted = 1 AND _id NOT IN (SELECT _id FROM T_Main_{{.T}})
 `
 	sqlIndexAttach  = "INSERT INTO T_Alt_{{.T}} (_id, name, value) VALUES (?, ?, ?)"
 	sqlIndexDetach  = "DELETE FROM T_Alt_{{.T}} WHERE name = ? AND value = ?"
-	sqlRecordDelete = "DELETE FROM T_Main_{{.T}} WHERE _id = ?"
+	sqlRecordState  = "SELECT _rev, _deleted FROM T_Main_{{.T}} WHERE _id = ?"
 	sqlIndexDelete  = "DELETE FROM T_Alt_{{.T}} WHERE _id = ?"
+	sqlChangeUpdate = "INSERT OR REPLACE INTO T_Seq_{{.T}} (_id, _rev, deleted) VALUES (?, ?, ?)"
+	sqlChangeQuery  = "SELECT seq, _id, _rev, deleted FROM T_Seq_{{.T}} WHERE seq > ? ORDER BY seq"
+	sqlLastSeq      = "SELECT COALESCE(MAX(seq), 0) FROM T_Seq_{{.T}}"
+	sqlDefList      = "SELECT def FROM T_Def_{{.T}} ORDER BY name"
+	sqlDefUpdate    = "INSERT OR REPLACE INTO T_Def_{{.T}} (name, def) VALUES (?, ?)"
+	sqlIndexClear   = "DELETE FROM T_Alt_{{.T}} WHERE name = ?"
+	sqlRecordDocs   = "SELECT _id, doc FROM T_Main_{{.T}} WHERE _deleted = 0"
+	sqlIndexHolder  = "SELECT _id FROM T_Alt_{{.T}} WHERE name = ? AND value = ? AND _id <> ? LIMIT 1"
+	sqlIndexShared  = "SELECT MAX(_id), value FROM T_Alt_{{.T}} WHERE name = ? GROUP BY value HAVING COUNT(*) > 1 LIMIT 1"
 )
 
+var tableStmts = []string{
+	sqlRecordInsert,
+	sqlRecordUpdate,
+	sqlRecordDelete,
+	sqlRecordState,
+	sqlIndexAttach,
+	sqlIndexDelete,
+	sqlIndexList,
+	sqlChangeUpdate,
+	sqlTombstonePurge,
+	sqlChangePurge,
+	sqlDefList,
+	sqlDefUpdate,
+	sqlIndexClear,
+	sqlRecordDocs,
+	sqlIndexHolder,
+	sqlIndexShared,
+}
+
 type Driver struct {
 }
 
@@ -75,12 +147,20 @@ type Database struct {
 	name   string
 	config Dictionary
 	tables map[string]*Table
+	db     *sql.DB
+	policy driver.Compaction
 	mutex  sync.RWMutex
 }
 
 type Table struct {
-	name string
-	db   *Database
+	name       string
+	db         *Database
+	stmts      map[string]*sql.Stmt
+	mutex      sync.Mutex
+	dropped    bool          // set once the table is dropped, refusing its use
+	dropMutex  sync.RWMutex  // held for reading while the table is used
+	watch      chan struct{} // closed on the next change made through this table
+	watchMutex sync.Mutex
 }
 
 func init() {
@@ -91,15 +171,106 @@ func NewDriver() *Driver {
 	return new(Driver)
 }
 
+// Path returns the file named by the "dsn" config key, or "" for a database
+// that lives in memory.
+func (this *Driver) Path(config Dictionary) string {
+	return dsnPath(config["dsn"])
+}
+
+// Configure opens a connection pool for the sqlite database named by the
+// "dsn" config key. The pool is bounded by the optional "max_open" and
+// "max_idle" keys. Private databases (":memory:" or "") exist only as long
+// as their connection, so they are limited to a single one; others are
+// opened as sharedDsn describes. Tables already in the database are
+// upgraded to the current schema.
 func (this *Driver) Configure(name string, config Dictionary) (driver.Database, *ergo.Error) {
+	maxOpen, kerr := getLimit(config, "max_open")
+	if kerr != nil {
+		return nil, kerr
+	}
+	maxIdle, kerr := getLimit(config, "max_idle")
+	if kerr != nil {
+		return nil, kerr
+	}
+	policy, kerr := driver.NewCompaction(config)
+	if kerr != nil {
+		return nil, kerr
+	}
+	dsn := config["dsn"]
+	if dsn == "" || dsn == ":memory:" {
+		maxOpen = 1
+		maxIdle = 1
+	} else {
+		dsn = sharedDsn(dsn)
+	}
+	pool, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	pool.SetMaxOpenConns(maxOpen)
+	if maxIdle != 0 {
+		pool.SetMaxIdleConns(maxIdle)
+	}
 	db := &Database{
 		name:   name,
 		config: config,
 		tables: make(map[string]*Table),
+		db:     pool,
+		policy: policy,
+	}
+	kerr = db.load()
+	if kerr != nil {
+		pool.Close()
+		return nil, kerr
 	}
 	return db, nil
 }
 
+func (this *Database) load() *ergo.Error {
+	err := migrate(this.db)
+	if err != nil {
+		return Wrap(err)
+	}
+	names, err := listTables(this.db)
+	if err != nil {
+		return Wrap(err)
+	}
+	for _, name := range names {
+		table, kerr := this.NewTable(name)
+		if kerr != nil {
+			return kerr
+		}
+		this.tables[name] = table
+	}
+	tx, err := this.db.Begin()
+	if err != nil {
+		return Wrap(err)
+	}
+	ref := referee{tx: tx}
+	defer ref.Close()
+	now := time.Now()
+	for _, table := range this.tables {
+		err = table.compact(tx, now)
+		if err != nil {
+			return Wrap(err)
+		}
+	}
+	ref.ok = true
+	return nil
+}
+
+func getLimit(config Dictionary, name string) (int, *ergo.Error) {
+	str, ok := config[name]
+	if !ok {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 0 {
+		return 0, NewError(EBadParam, "name", name, "value", str)
+	}
+	return value, nil
+}
+
 func (this *Database) Name() string {
 	return this.name
 }
@@ -112,6 +283,11 @@ func (this *Database) Config() Dictionary {
 	return this.config
 }
 
+// Serial reports whether the pool is limited to a single connection.
+func (this *Database) Serial() bool {
+	return this.db.Stats().MaxOpenConnections == 1
+}
+
 func (this *Database) GetTable(name string, create bool) (driver.Table, *ergo.Error) {
 	if create {
 		this.mutex.Lock()
@@ -136,41 +312,294 @@ func (this *Database) GetTable(name string, create bool) (driver.Table, *ergo.Er
 	return table, nil
 }
 
+func (this *Database) DropTable(name string) *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	table, ok := this.tables[name]
+	if !ok {
+		return NewError(EBadTable, "name", name)
+	}
+	// a handle kept on the table must not reach the next one of that name
+	table.dropMutex.Lock()
+	defer table.dropMutex.Unlock()
+	table.close()
+	_, err := this.db.Exec(compile(sqlDropSchema, name, ""))
+	if err != nil {
+		return Wrap(err)
+	}
+	table.dropped = true
+	delete(this.tables, name)
+	return nil
+}
+
+// drop makes the table refuse to be used.
+func (this *Table) drop() {
+	this.dropMutex.Lock()
+	defer this.dropMutex.Unlock()
+	this.dropped = true
+	this.close()
+}
+
+// acquire holds the table until release is called, failing with EBadTable
+// if it has been dropped.
+func (this *Table) acquire() *ergo.Error {
+	this.dropMutex.RLock()
+	if this.dropped {
+		this.dropMutex.RUnlock()
+		return NewError(EBadTable, "name", this.name)
+	}
+	return nil
+}
+
+func (this *Table) release() {
+	this.dropMutex.RUnlock()
+}
+
+func (this *Database) ListTables() ([]string, *ergo.Error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	names := []string{}
+	for name := range this.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Drop drops every table through the open connection, so that nothing is
+// left behind whatever the dsn, then removes the database file along with
+// its journals.
+func (this *Database) Drop() *ergo.Error {
+	kerr := this.dropTables()
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.Close()
+	if kerr != nil {
+		return kerr
+	}
+	path := dsnPath(this.config["dsn"])
+	if path == "" {
+		return nil
+	}
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		err := os.Remove(path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return Wrap(err)
+		}
+	}
+	return nil
+}
+
+// dropTables drops every table found in the database, including those
+// created by other processes sharing the file.
+func (this *Database) dropTables() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, table := range this.tables {
+		table.drop()
+	}
+	names, err := listTables(this.db)
+	if err != nil {
+		return Wrap(err)
+	}
+	for _, name := range names {
+		_, err = this.db.Exec(compile(sqlDropSchema, name, ""))
+		if err != nil {
+			return Wrap(err)
+		}
+	}
+	return nil
+}
+
+// busyTimeout is how long, in milliseconds, a connection waits for another
+// to release the database's lock.
+const busyTimeout = "5000"
+
+// sharedDsn returns dsn set up for connections that share the database:
+// transactions begin IMMEDIATE, taking the write lock up front, as two
+// that both read before writing would otherwise deadlock upgrading their
+// read locks, failing one with SQLITE_BUSY. Connections wait busyTimeout
+// for the lock. Either is left alone when dsn sets it.
+func sharedDsn(dsn string) string {
+	params := url.Values{}
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		params, _ = url.ParseQuery(dsn[i+1:])
+	}
+	extra := url.Values{}
+	if params.Get("_txlock") == "" {
+		extra.Set("_txlock", "immediate")
+	}
+	if params.Get("_busy_timeout") == "" && params.Get("_timeout") == "" {
+		extra.Set("_busy_timeout", busyTimeout)
+	}
+	if len(extra) == 0 {
+		return dsn
+	}
+	if strings.IndexByte(dsn, '?') < 0 {
+		return dsn + "?" + extra.Encode()
+	}
+	return dsn + "&" + extra.Encode()
+}
+
+// dsnPath returns the file named by a dsn, which is either a path or a
+// "file:" URI, or "" if the database lives in memory.
+func dsnPath(dsn string) string {
+	path := dsn
+	var params string
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, params = path[:i], path[i+1:]
+	}
+	if strings.HasPrefix(path, "file:") {
+		path = path[len("file:"):]
+		if strings.HasPrefix(path, "//") {
+			// skip the authority, which sqlite only allows to be empty or
+			// "localhost"
+			i := strings.IndexByte(path[2:], '/')
+			if i < 0 {
+				return ""
+			}
+			path = path[2+i:]
+		}
+		unescaped, err := url.PathUnescape(path)
+		if err == nil {
+			path = unescaped
+		}
+		values, _ := url.ParseQuery(params)
+		if values.Get("mode") == "memory" {
+			return ""
+		}
+	}
+	if path == ":memory:" {
+		return ""
+	}
+	return path
+}
+
+func (this *Database) Close() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, table := range this.tables {
+		table.drop()
+	}
+	this.tables = make(map[string]*Table)
+	err := this.db.Close()
+	if err != nil {
+		return Wrap(err)
+	}
+	return nil
+}
+
 func (this *Database) NewTable(name string) (*Table, *ergo.Error) {
-	db, err := sql.Open("sqlite3", this.config["dsn"])
+	_, err := this.db.Exec(compile(sqlSchema, name, ""))
 	if err != nil {
 		return nil, Wrap(err)
 	}
-	defer db.Close()
-	_, err = db.Exec(compile(sqlSchema, name, ""))
+	table := newTable(this, name)
+	err = table.prepareAll()
 	if err != nil {
 		return nil, Wrap(err)
 	}
-	return &Table{name, this}, nil
+	return table, nil
+}
+
+func newTable(db *Database, name string) *Table {
+	return &Table{
+		name:  name,
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+		watch: make(chan struct{}),
+	}
+}
+
+// prepareAll prepares the statements used inside a transaction up front,
+// so that they needn't be prepared on the transaction's connection.
+func (this *Table) prepareAll() error {
+	for _, text := range tableStmts {
+		_, err := this.prepare(text, "", "")
+		if err != nil {
+			this.close()
+			return err
+		}
+	}
+	return nil
 }
 
 func compile(text, table, where string) string {
+	return compileOrdered(text, table, where, "")
+}
+
+// compileOrdered is like compile but also fills in the sort direction
+// ("" or " DESC") used by the ORDER BY clause of a query.
+func compileOrdered(text, table, where, order string) string {
 	var buf bytes.Buffer
 	tmpl := template.Must(template.New("").Parse(text))
-	err := tmpl.Execute(&buf, struct{ T, W string }{table, where})
+	err := tmpl.Execute(&buf, struct{ T, W, O string }{table, where, order})
 	if err != nil {
 		panic(err)
 	}
 	return buf.String()
 }
 
-func (this *Table) where(query *Query) (string, []interface{}) {
+// prepare returns a cached statement for the given template.
+func (this *Table) prepare(text, where, order string) (*sql.Stmt, error) {
+	query := compileOrdered(text, this.name, where, order)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	stmt, ok := this.stmts[query]
+	if ok {
+		return stmt, nil
+	}
+	stmt, err := this.db.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	this.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (this *Table) close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, stmt := range this.stmts {
+		stmt.Close()
+	}
+	this.stmts = make(map[string]*sql.Stmt)
+}
+
+func (this *Table) where(query *Query) (string, []interface{}, *ergo.Error) {
 	// fmt.Printf("Where: (%v, %v)\n", query.Lower, query.Upper)
 	exprs := []string{}
 	var args []interface{}
 	var selector string
 	if query.Index == "_id" {
 		selector = query.Index
+		if !query.Deleted {
+			// tombstones have no index entries to begin with
+			exprs = append(exprs, "_deleted = 0")
+		}
 	} else {
 		exprs = append(exprs, "i.name = ?")
 		args = append(args, query.Index)
 		selector = "i.value"
 	}
+	if query.After != "" {
+		value, id, err := ParseCursor(query.After)
+		if err != nil {
+			return "", nil, err
+		}
+		op := ">"
+		if query.Descending {
+			op = "<"
+		}
+		if query.Index == "_id" {
+			exprs = append(exprs, "_id "+op+" ?")
+			args = append(args, id)
+		} else {
+			exprs = append(exprs, "(i.value "+op+" ? OR (i.value = ? AND i._id "+op+" ?))")
+			args = append(args, value, value, id)
+		}
+	}
 	if query.Lower.IsDefined() && query.Upper.IsDefined() &&
 		query.Lower.Value == query.Upper.Value {
 		exprs = append(exprs, selector+" = ?")
@@ -194,13 +623,24 @@ func (this *Table) where(query *Query) (string, []interface{}) {
 		}
 	}
 	if len(exprs) == 0 {
-		return "", args
+		return "", args, nil
 	}
-	return "\nWHERE " + strings.Join(exprs, " AND "), args
+	return "\nWHERE " + strings.Join(exprs, " AND "), args, nil
 }
 
-func (this *Table) prepareQuery(query *Query) (string, []interface{}) {
-	where, args := this.where(query)
+// compileQuery returns the template, WHERE clause, sort direction and
+// arguments of the statement that runs query.
+func (this *Table) compileQuery(query *Query) (string, string, string, []interface{}, *ergo.Error) {
+	if query.Index == "" {
+		return "", "", "", nil, NewError(EBadIndex, "name", query.Index)
+	}
+	if query.Limit == 0 {
+		return "", "", "", nil, NewError(EBadParam, "name", "limit", "value", query.Limit)
+	}
+	where, args, kerr := this.where(query)
+	if kerr != nil {
+		return "", "", "", nil, kerr
+	}
 	args = append(args, query.Limit+1)
 	var text string
 	if query.Index == "_id" {
@@ -208,55 +648,69 @@ func (this *Table) prepareQuery(query *Query) (string, []interface{}) {
 	} else {
 		text = sqlIndexQuery
 	}
-	return compile(text, this.name, where), args
+	var order string
+	if query.Descending {
+		order = " DESC"
+	}
+	return text, where, order, args, nil
 }
 
-func (this *Table) Get(query *Query) (chan (*Record), *ergo.Error) {
-	if query.Index == "" {
-		return nil, NewError(EBadIndex, "name", query.Index)
+func (this *Table) Get(ctx context.Context, query *Query) (chan (*Record), *ergo.Error) {
+	return driver.Stream(ctx, query, func(query *Query) ([]*Record, bool, *ergo.Error) {
+		return this.page(ctx, query)
+	})
+}
+
+// page reads up to query.Limit records, closing the rows before returning
+// so that the connection goes back to the pool.
+func (this *Table) page(ctx context.Context, query *Query) ([]*Record, bool, *ergo.Error) {
+	kerr := this.acquire()
+	if kerr != nil {
+		return nil, false, kerr
 	}
-	if query.Limit == 0 {
-		return nil, NewError(EBadParam, "name", "limit", "value", query.Limit)
+	defer this.release()
+	text, where, order, args, kerr := this.compileQuery(query)
+	if kerr != nil {
+		return nil, false, kerr
 	}
-	db, err := sql.Open("sqlite3", this.db.config["dsn"])
+	stmt, err := this.prepare(text, where, order)
 	if err != nil {
-		return nil, Wrap(err)
+		return nil, false, Wrap(err)
 	}
-	stmt, args := this.prepareQuery(query)
-	rows, err := db.Query(stmt, args...)
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
-		db.Close()
-		return nil, Wrap(err)
+		return nil, false, Wrap(err)
 	}
-	ch := make(chan (*Record))
-	go func() {
-		defer db.Close()
-		defer rows.Close()
-		defer close(ch)
-		var count uint
-		for rows.Next() {
-			var record Record
-			var doc string
-			err := rows.Scan(&record.Id, &record.Rev, &doc)
-			if err != nil {
-				fmt.Printf("Scan failed: %v\n", err)
-				return
-			}
-			buf := bytes.NewBufferString(doc)
-			err = json.NewDecoder(buf).Decode(&record.Doc)
-			if err != nil {
-				fmt.Printf("JSON decode failed: %v\n", err)
-				return
-			}
-			if count == query.Limit {
-				return
-			}
-			ch <- &record
-			count++
+	return scan(rows, query.Limit)
+}
+
+// scan reads up to limit records from rows, reporting whether more follow,
+// and closes them.
+func scan(rows *sql.Rows, limit uint) ([]*Record, bool, *ergo.Error) {
+	defer rows.Close()
+	records := []*Record{}
+	for rows.Next() {
+		if uint(len(records)) == limit {
+			return records, true, nil
 		}
-		ch <- nil
-	}()
-	return ch, nil
+		var record Record
+		var value, doc string
+		err := rows.Scan(&value, &record.Id, &record.Rev, &doc, &record.Deleted)
+		if err != nil {
+			return nil, false, Wrap(err)
+		}
+		var kerr *ergo.Error
+		record.Doc, kerr = driver.ExportDoc(doc)
+		if kerr != nil {
+			return nil, false, kerr
+		}
+		record.Cursor = NewCursor(value, record.Id)
+		records = append(records, &record)
+	}
+	if rows.Err() != nil {
+		return nil, false, Wrap(rows.Err())
+	}
+	return records, false, nil
 }
 
 type referee struct {
@@ -273,76 +727,499 @@ func (this *referee) Close() {
 }
 
 func (this *Table) Put(record *Record) (string, *ergo.Error) {
+	results, kerr := this.PutMany([]*Record{record}, true)
+	if kerr != nil {
+		return "", kerr
+	}
+	record.Rev = results[0].Rev
+	return record.Rev, nil
+}
+
+func (this *Table) Delete(id, rev string) (string, *ergo.Error) {
+	results, kerr := this.PutMany([]*Record{{Id: id, Rev: rev, Deleted: true}}, true)
+	if kerr != nil {
+		return "", kerr
+	}
+	return results[0].Rev, nil
+}
+
+func (this *Table) PutMany(records []*Record, atomic bool) ([]*BulkResult, *ergo.Error) {
+	results, changed, kerr := this.putMany(records, atomic)
+	if kerr != nil {
+		return nil, kerr
+	}
+	if changed {
+		this.notify()
+	}
+	return results, nil
+}
+
+// putMany writes the records in a single transaction. Unless atomic is set,
+// each record gets a savepoint of its own so that a failure only undoes
+// that record.
+func (this *Table) putMany(records []*Record, atomic bool) ([]*BulkResult, bool, *ergo.Error) {
+	kerr := this.acquire()
+	if kerr != nil {
+		return nil, false, kerr
+	}
+	defer this.release()
+	now := time.Now()
+	tx, err := this.db.db.Begin()
+	if err != nil {
+		return nil, false, Wrap(err)
+	}
+	ref := referee{tx: tx}
+	defer ref.Close()
+	results := make([]*BulkResult, len(records))
+	changed := false
+	for i, record := range records {
+		results[i] = &BulkResult{Id: record.Id}
+		if !atomic {
+			_, err = tx.Exec("SAVEPOINT record")
+			if err != nil {
+				return nil, false, Wrap(err)
+			}
+		}
+		var kerr *ergo.Error
+		if record.Deleted {
+			results[i].Rev, kerr = this.delete(tx, record.Id, record.Rev, now)
+		} else {
+			results[i].Rev, kerr = this.put(tx, record)
+		}
+		if kerr != nil {
+			if atomic {
+				return nil, false, kerr
+			}
+			results[i].Rev = ""
+			results[i].Error = kerr
+			_, err = tx.Exec("ROLLBACK TO record")
+			if err != nil {
+				return nil, false, Wrap(err)
+			}
+		}
+		changed = changed || results[i].Rev != ""
+		if !atomic {
+			_, err = tx.Exec("RELEASE record")
+			if err != nil {
+				return nil, false, Wrap(err)
+			}
+		}
+	}
+	if changed {
+		err = this.compact(tx, now)
+		if err != nil {
+			return nil, false, Wrap(err)
+		}
+	}
+	ref.ok = true
+	return results, changed, nil
+}
+
+func (this *Table) put(tx *sql.Tx, record *Record) (string, *ergo.Error) {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(record.Doc)
 	if err != nil {
 		return "", Wrap(err)
 	}
 	doc := buf.String()
-	hasher := sha1.New()
-	io.WriteString(hasher, doc)
-	rev := fmt.Sprintf("%x", hasher.Sum(nil))
-	db, err := sql.Open("sqlite3", this.db.config["dsn"])
-	if err != nil {
-		return "", Wrap(err)
-	}
-	defer db.Close()
-	tx, err := db.Begin()
-	if err != nil {
-		return "", Wrap(err)
+	prev := record.Rev
+	if prev == "" {
+		// a tombstone may be replaced without knowing its revision
+		var deleted bool
+		err = this.query(tx, sqlRecordState, record.Id).Scan(&prev, &deleted)
+		if err != nil && err != sql.ErrNoRows {
+			return "", Wrap(err)
+		}
+		if err == nil && !deleted {
+			return "", NewError(EConflict, "id", record.Id)
+		}
 	}
-	ref := referee{tx: tx}
-	defer ref.Close()
-	if record.Rev == "" {
-		_, err = tx.Exec(compile(sqlRecordInsert, this.name, ""), record.Id, rev, doc)
+	rev := NewRevision(prev, doc)
+	if prev == "" {
+		_, err = this.exec(tx, sqlRecordInsert, record.Id, rev, doc)
 		if err != nil {
-			return "", NewError(EConflict, "err", err.Error())
+			return "", NewError(EConflict, "id", record.Id, "err", err.Error())
 		}
 	} else {
-		result, err := tx.Exec(compile(sqlRecordUpdate, this.name, ""),
-			rev, doc, record.Id, record.Rev)
+		result, err := this.exec(tx, sqlRecordUpdate, rev, doc, record.Id, prev)
+		if err != nil {
+			return "", Wrap(err)
+		}
 		rows, err := result.RowsAffected()
 		if err != nil || rows != 1 {
-			return "", NewError(EConflict)
+			return "", NewError(EConflict, "id", record.Id)
 		}
 	}
-	_, err = tx.Exec(compile(sqlIndexDelete, this.name, ""), record.Id)
+	_, err = this.exec(tx, sqlIndexDelete, record.Id)
 	if err != nil {
 		return "", Wrap(err)
 	}
-	for name, keys := range record.Keys {
+	defs, err := this.indexDefs(tx)
+	if err != nil {
+		return "", Wrap(err)
+	}
+	indexed, kerr := driver.ComputeKeys(defs, record.Keys, doc)
+	if kerr != nil {
+		return "", kerr
+	}
+	// the record was written above, so the transaction already holds the
+	// write lock and no other one can take a key in between
+	for _, def := range defs {
+		if !def.Unique {
+			continue
+		}
+		for _, key := range indexed[def.Name] {
+			var holder string
+			err = this.query(tx, sqlIndexHolder, def.Name, key, record.Id).Scan(&holder)
+			if err == nil {
+				return "", NewError(EConflict, "id", record.Id, "index", def.Name, "key", key)
+			}
+			if err != sql.ErrNoRows {
+				return "", Wrap(err)
+			}
+		}
+	}
+	for name, keys := range indexed {
 		for _, key := range keys {
-			_, err = tx.Exec(compile(sqlIndexAttach, this.name, ""), record.Id, name, key)
+			_, err = this.exec(tx, sqlIndexAttach, record.Id, name, key)
 			if err != nil {
 				return "", Wrap(err)
 			}
 		}
 	}
-	ref.ok = true
-	record.Rev = rev
+	_, err = this.exec(tx, sqlChangeUpdate, record.Id, rev, false)
+	if err != nil {
+		return "", Wrap(err)
+	}
 	return rev, nil
 }
 
-func (this *Table) Delete(id string) *ergo.Error {
-	db, err := sql.Open("sqlite3", this.db.config["dsn"])
+// exec runs a statement within tx.
+func (this *Table) exec(tx *sql.Tx, text string, args ...interface{}) (sql.Result, error) {
+	stmt, err := this.stmt(tx, text)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+// query runs a single row query within tx.
+func (this *Table) query(tx *sql.Tx, text string, args ...interface{}) *sql.Row {
+	stmt, err := this.stmt(tx, text)
+	if err != nil {
+		// the error resurfaces from Scan
+		return tx.QueryRow(compile(text, this.name, ""), args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+// stmt returns the cached statement for text bound to tx. A statement
+// that isn't cached, such as one for a table created by tx itself, is
+// prepared on tx's own connection instead, since preparing it on the pool
+// could need a second connection.
+func (this *Table) stmt(tx *sql.Tx, text string) (*sql.Stmt, error) {
+	query := compile(text, this.name, "")
+	this.mutex.Lock()
+	stmt, ok := this.stmts[query]
+	this.mutex.Unlock()
+	if ok {
+		return tx.Stmt(stmt), nil
+	}
+	return tx.Prepare(query)
+}
+
+func (this *Table) delete(tx *sql.Tx, id, rev string, now time.Time) (string, *ergo.Error) {
+	tombRev := NewRevision(rev, "")
+	result, err := this.exec(tx, sqlRecordDelete, tombRev, now.UnixNano(), id, rev)
+	if err != nil {
+		return "", Wrap(err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return "", Wrap(err)
+	}
+	if rows != 1 {
+		var cur string
+		var deleted bool
+		err = this.query(tx, sqlRecordState, id).Scan(&cur, &deleted)
+		if err == sql.ErrNoRows || (err == nil && deleted) {
+			return "", nil
+		}
+		if err != nil {
+			return "", Wrap(err)
+		}
+		return "", NewError(EConflict, "id", id)
+	}
+	_, err = this.exec(tx, sqlIndexDelete, id)
+	if err != nil {
+		return "", Wrap(err)
+	}
+	_, err = this.exec(tx, sqlChangeUpdate, id, tombRev, true)
+	if err != nil {
+		return "", Wrap(err)
+	}
+	return tombRev, nil
+}
+
+// compact purges the tombstones that the database's policy no longer keeps.
+func (this *Table) compact(tx *sql.Tx, now time.Time) error {
+	policy := this.db.policy
+	if policy.TTL == 0 && policy.Max == 0 {
+		return nil
+	}
+	var cutoff int64 = -1
+	if policy.TTL != 0 {
+		cutoff = now.Add(-policy.TTL).UnixNano()
+	}
+	limit := -1
+	if policy.Max != 0 {
+		limit = policy.Max
+	}
+	result, err := this.exec(tx, sqlTombstonePurge, cutoff, limit)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return err
+	}
+	_, err = this.exec(tx, sqlChangePurge)
+	return err
+}
+
+// notify wakes up everyone watching for changes. It is called once a
+// change has been committed. Changes made by other processes sharing the
+// same database file are only noticed along with the next local one.
+func (this *Table) notify() {
+	this.watchMutex.Lock()
+	defer this.watchMutex.Unlock()
+	close(this.watch)
+	this.watch = make(chan struct{})
+}
+
+func (this *Table) Watch(since uint64) (<-chan struct{}, *ergo.Error) {
+	kerr := this.acquire()
+	if kerr != nil {
+		return nil, kerr
+	}
+	defer this.release()
+	stmt, err := this.prepare(sqlLastSeq, "", "")
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	this.watchMutex.Lock()
+	defer this.watchMutex.Unlock()
+	var seq int64
+	err = stmt.QueryRow().Scan(&seq)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	if uint64(seq) > since {
+		ch := make(chan struct{})
+		close(ch)
+		return ch, nil
+	}
+	return this.watch, nil
+}
+
+func (this *Table) Changes(ctx context.Context, since uint64) (chan (*Change), *ergo.Error) {
+	kerr := this.acquire()
+	if kerr != nil {
+		return nil, kerr
+	}
+	defer this.release()
+	stmt, err := this.prepare(sqlChangeQuery, "", "")
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	rows, err := stmt.QueryContext(ctx, int64(since))
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	// the changes are read first, so that the connection goes back to the
+	// pool while they wait to be received
+	changes := []*Change{}
+	for rows.Next() {
+		var change Change
+		var seq int64
+		err = rows.Scan(&seq, &change.Id, &change.Rev, &change.Deleted)
+		if err != nil {
+			rows.Close()
+			return nil, Wrap(err)
+		}
+		change.Seq = uint64(seq)
+		changes = append(changes, &change)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, Wrap(rows.Err())
+	}
+	ch := make(chan (*Change))
+	go func() {
+		defer close(ch)
+		for _, change := range changes {
+			select {
+			case ch <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (this *Table) ListIndexes() ([]string, *ergo.Error) {
+	kerr := this.acquire()
+	if kerr != nil {
+		return nil, kerr
+	}
+	defer this.release()
+	stmt, err := this.prepare(sqlIndexList, "", "")
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	defer rows.Close()
+	names := []string{"_id"}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, Wrap(err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (this *Table) ListIndexDefs() ([]*IndexDef, *ergo.Error) {
+	kerr := this.acquire()
+	if kerr != nil {
+		return nil, kerr
+	}
+	defer this.release()
+	tx, err := this.db.db.Begin()
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	defer tx.Rollback()
+	defs, err := this.indexDefs(tx)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	return defs, nil
+}
+
+// indexDefs reads the table's computed indexes within tx, so that a write
+// sees the definitions as of its own transaction.
+func (this *Table) indexDefs(tx *sql.Tx) ([]*IndexDef, error) {
+	stmt, err := this.stmt(tx, sqlDefList)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	defs := []*IndexDef{}
+	for rows.Next() {
+		var text string
+		err = rows.Scan(&text)
+		if err != nil {
+			return nil, err
+		}
+		var def IndexDef
+		err = json.Unmarshal([]byte(text), &def)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, &def)
+	}
+	return defs, rows.Err()
+}
+
+// DefineIndex records the definition and computes the index's keys for
+// every record in one transaction, which fails with EConflict if the index
+// is unique and two records share a key.
+func (this *Table) DefineIndex(def *IndexDef) *ergo.Error {
+	kerr := def.Validate()
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.acquire()
+	if kerr != nil {
+		return kerr
+	}
+	defer this.release()
+	raw, err := json.Marshal(def)
 	if err != nil {
 		return Wrap(err)
 	}
-	defer db.Close()
-	tx, err := db.Begin()
+	tx, err := this.db.db.Begin()
 	if err != nil {
 		return Wrap(err)
 	}
 	ref := referee{tx: tx}
 	defer ref.Close()
-	_, err = tx.Exec(compile(sqlIndexDelete, this.name, ""), id)
+	_, err = this.exec(tx, sqlDefUpdate, def.Name, string(raw))
+	if err != nil {
+		return Wrap(err)
+	}
+	_, err = this.exec(tx, sqlIndexClear, def.Name)
 	if err != nil {
 		return Wrap(err)
 	}
-	_, err = tx.Exec(compile(sqlRecordDelete, this.name, ""), id)
+	// read everything first, so that the rows are closed before the
+	// transaction's connection is written to
+	stmt, err := this.stmt(tx, sqlRecordDocs)
 	if err != nil {
 		return Wrap(err)
 	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return Wrap(err)
+	}
+	docs := make(map[string]string)
+	for rows.Next() {
+		var id, doc string
+		err = rows.Scan(&id, &doc)
+		if err != nil {
+			rows.Close()
+			return Wrap(err)
+		}
+		docs[id] = doc
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return Wrap(rows.Err())
+	}
+	for id, doc := range docs {
+		decoded, kerr := driver.DecodeDoc(doc)
+		if kerr != nil {
+			return kerr
+		}
+		for _, key := range def.Keys(decoded) {
+			_, err = this.exec(tx, sqlIndexAttach, id, def.Name, key)
+			if err != nil {
+				return Wrap(err)
+			}
+		}
+	}
+	if def.Unique {
+		var id, key string
+		err = this.query(tx, sqlIndexShared, def.Name).Scan(&id, &key)
+		if err == nil {
+			return NewError(EConflict, "id", id, "index", def.Name, "key", key)
+		}
+		if err != sql.ErrNoRows {
+			return Wrap(err)
+		}
+	}
 	ref.ok = true
 	return nil
 }
@@ -1,13 +1,18 @@
 package sql
 
 import (
+	"context"
 	"database/sql"
+	"github.com/flaub/ergo"
 	. "github.com/flaub/kissdif"
+	"github.com/flaub/kissdif/driver"
 	"github.com/flaub/kissdif/driver/test"
 	. "github.com/motain/gocheck"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -21,9 +26,19 @@ type TestDriver struct {
 	*test.TestSuite
 }
 
+type TestMemory struct {
+	*test.TestSuite
+}
+
 func init() {
 	Suite(&TestSuite{})
 	Suite(&TestDriver{TestSuite: test.NewTestSuite("sql")})
+	Suite(&TestMemory{TestSuite: test.NewTestSuite("sql")})
+}
+
+func (this *TestMemory) SetUpTest(c *C) {
+	this.Config = Dictionary{"dsn": ":memory:"}
+	this.TestSuite.SetUpTest(c)
 }
 
 func (this *TestDriver) SetUpTest(c *C) {
@@ -78,7 +93,8 @@ func (this *TestSuite) TestQueryOptimizer(c *C) {
 	this.explain(c, db, compile(sqlIndexQuery, table, "\nWHERE i.name = ? AND i.value > ? AND i.value < ?"), 10, "", "", "")
 
 	this.explain(c, db, compile(sqlRecordUpdate, table, ""), "", "", "", "")
-	this.explain(c, db, compile(sqlRecordDelete, table, ""), "")
+	this.explain(c, db, compile(sqlRecordDelete, table, ""), "", 0, "", "")
+	this.explain(c, db, compile(sqlRecordState, table, ""), "")
 
 	this.explain(c, db, compile(sqlIndexDelete, table, ""), "")
 	this.explain(c, db, compile(sqlIndexDetach, table, ""), "", "")
@@ -91,3 +107,252 @@ func (this *TestSuite) SetUpTest(c *C) {
 func (this *TestSuite) TearDownTest(c *C) {
 	os.Remove(this.path)
 }
+
+func (this *TestSuite) TestPoolLimits(c *C) {
+	_, err := NewDriver().Configure("db", Dictionary{"dsn": this.path, "max_open": "x"})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadParam)
+	_, err = NewDriver().Configure("db", Dictionary{"dsn": this.path, "max_idle": "-1"})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadParam)
+	db, err := NewDriver().Configure("db", Dictionary{"dsn": this.path, "max_open": "4", "max_idle": "2"})
+	c.Assert(err, IsNil)
+	c.Check(db.(*Database).db.Stats().MaxOpenConnections, Equals, 4)
+	c.Assert(db.Drop(), IsNil)
+}
+
+func (this *TestSuite) TestDropFile(c *C) {
+	dsn := "file:" + this.path + "?_journal_mode=WAL"
+	db, err := NewDriver().Configure("db", Dictionary{"dsn": dsn})
+	c.Assert(err, IsNil)
+	table, err := db.GetTable("table", true)
+	c.Assert(err, IsNil)
+	_, err = table.Put(&Record{Id: "1", Doc: "one"})
+	c.Assert(err, IsNil)
+	_, serr := os.Stat(this.path + "-wal")
+	c.Assert(serr, IsNil)
+	c.Assert(db.Drop(), IsNil)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		_, serr = os.Stat(this.path + suffix)
+		c.Check(os.IsNotExist(serr), Equals, true, Commentf("%q", suffix))
+	}
+	c.Check(dsnPath("file:///tmp/a%20b.db?mode=rwc"), Equals, "/tmp/a b.db")
+	c.Check(dsnPath("file:x.db"), Equals, "x.db")
+	c.Check(dsnPath("file::memory:?cache=shared"), Equals, "")
+	c.Check(dsnPath("file:x.db?mode=memory"), Equals, "")
+	c.Check(dsnPath(":memory:"), Equals, "")
+}
+
+// TestConcurrentWriters runs transactions that read before they write on
+// connections of their own, which sqlite would deadlock, failing one with
+// SQLITE_BUSY, if both took a read lock before upgrading it.
+func (this *TestSuite) TestConcurrentWriters(c *C) {
+	db, err := NewDriver().Configure("db", Dictionary{"dsn": this.path, "max_open": "8"})
+	c.Assert(err, IsNil)
+	defer db.Drop()
+	_, err = db.GetTable("table", true)
+	c.Assert(err, IsNil)
+	const writers = 8
+	errs := make(chan *ergo.Error, writers)
+	for i := 0; i < writers; i++ {
+		go func(id string) {
+			errs <- func() *ergo.Error {
+				tx, kerr := db.Begin()
+				if kerr != nil {
+					return kerr
+				}
+				ch, kerr := tx.Get(context.Background(), "table", &Query{Index: "_id", Limit: 10})
+				if kerr != nil {
+					tx.Rollback()
+					return kerr
+				}
+				for range ch {
+				}
+				time.Sleep(10 * time.Millisecond)
+				_, kerr = tx.Put("table", &Record{Id: id, Doc: id})
+				if kerr != nil {
+					tx.Rollback()
+					return kerr
+				}
+				return tx.Commit()
+			}()
+		}(strconv.Itoa(i))
+	}
+	for i := 0; i < writers; i++ {
+		c.Check(<-errs, IsNil)
+	}
+	c.Check(sharedDsn("x.db"), Equals, "x.db?_busy_timeout=5000&_txlock=immediate")
+	c.Check(sharedDsn("file:x.db?_txlock=deferred"), Equals, "file:x.db?_txlock=deferred&_busy_timeout=5000")
+	c.Check(sharedDsn("x.db?_timeout=1&_txlock=exclusive"), Equals, "x.db?_timeout=1&_txlock=exclusive")
+}
+
+func (this *TestSuite) openTable(c *C) *Table {
+	db, err := NewDriver().Configure("db", Dictionary{"dsn": this.path})
+	c.Assert(err, IsNil)
+	table, err := db.GetTable("table", true)
+	c.Assert(err, IsNil)
+	return table.(*Table)
+}
+
+func (this *TestSuite) BenchmarkPut(c *C) {
+	table := this.openTable(c)
+	defer table.db.Drop()
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		id := strconv.Itoa(i)
+		_, err := table.Put(&Record{Id: id, Doc: id, Keys: IndexMap{"name": {id}}})
+		c.Assert(err, IsNil)
+	}
+}
+
+func (this *TestSuite) BenchmarkGet(c *C) {
+	table := this.openTable(c)
+	defer table.db.Drop()
+	_, err := table.Put(&Record{Id: "1", Doc: "1"})
+	c.Assert(err, IsNil)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		ch, err := table.Get(context.Background(), NewQueryEQ("_id", "1", 1))
+		c.Assert(err, IsNil)
+		for _ = range ch {
+		}
+	}
+}
+
+// BenchmarkPutUnpooled and BenchmarkGetUnpooled open a new connection for
+// every operation, for comparison with the pooled driver.
+func (this *TestSuite) BenchmarkPutUnpooled(c *C) {
+	table := this.openTable(c)
+	defer table.db.Drop()
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		id := strconv.Itoa(i)
+		db, err := sql.Open("sqlite3", this.path)
+		c.Assert(err, IsNil)
+		tx, err := db.Begin()
+		c.Assert(err, IsNil)
+		_, err = tx.Exec(compile(sqlRecordInsert, table.name, ""), id, id, id)
+		c.Assert(err, IsNil)
+		_, err = tx.Exec(compile(sqlIndexDelete, table.name, ""), id)
+		c.Assert(err, IsNil)
+		_, err = tx.Exec(compile(sqlIndexAttach, table.name, ""), id, "name", id)
+		c.Assert(err, IsNil)
+		c.Assert(tx.Commit(), IsNil)
+		db.Close()
+	}
+}
+
+func (this *TestSuite) BenchmarkGetUnpooled(c *C) {
+	table := this.openTable(c)
+	defer table.db.Drop()
+	_, err := table.Put(&Record{Id: "1", Doc: "1"})
+	c.Assert(err, IsNil)
+	query := compile(sqlRecordQuery, table.name, "\nWHERE _id = ?")
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		db, err := sql.Open("sqlite3", this.path)
+		c.Assert(err, IsNil)
+		rows, err := db.Query(query, "1", 2)
+		c.Assert(err, IsNil)
+		for rows.Next() {
+			var value, id, rev, doc string
+			c.Assert(rows.Scan(&value, &id, &rev, &doc), IsNil)
+		}
+		rows.Close()
+		db.Close()
+	}
+}
+
+func (this *TestSuite) TestNumericIds(c *C) {
+	table := this.openTable(c)
+	defer table.db.Drop()
+	_, err := table.Put(&Record{Id: "1", Doc: "one"})
+	c.Assert(err, IsNil)
+	_, err = table.Put(&Record{Id: "01", Doc: "zero one"})
+	c.Assert(err, IsNil)
+	ch, err := table.Get(context.Background(), NewQueryEQ("_id", "01", 10))
+	c.Assert(err, IsNil)
+	record := <-ch
+	c.Assert(record, NotNil)
+	c.Check(record.Doc, Equals, "zero one")
+	c.Check(<-ch, IsNil)
+}
+
+// TestFailedPage checks that a query failing after its first page reports
+// why, rather than looking like one cut short by its limit.
+func (this *TestSuite) TestFailedPage(c *C) {
+	table := this.openTable(c)
+	defer table.db.Drop()
+	records := []*Record{}
+	for i := 0; i < driver.PageSize+10; i++ {
+		id := strconv.Itoa(i)
+		records = append(records, &Record{Id: id, Doc: id})
+	}
+	_, kerr := table.PutMany(records, true)
+	c.Assert(kerr, IsNil)
+
+	ctx, failure := driver.WithFailure(context.Background())
+	ch, kerr := table.Get(ctx, &Query{Index: "_id", Limit: 1000})
+	c.Assert(kerr, IsNil)
+	c.Assert(<-ch, NotNil)
+	c.Assert(table.db.DropTable("table"), IsNil)
+	count := 1
+	for record := range ch {
+		c.Assert(record, NotNil)
+		count++
+	}
+	c.Check(count, Equals, driver.PageSize)
+	c.Assert(failure.Err(), NotNil)
+	c.Check(failure.Err().Code, Equals, EBadTable)
+}
+
+func (this *TestSuite) TestMigrate(c *C) {
+	db, err := sql.Open("sqlite3", this.path)
+	c.Assert(err, IsNil)
+	_, err = db.Exec(`
+CREATE TABLE T_Main_t (_id INT NOT NULL, _rev INT NOT NULL, doc TEXT NOT NULL, PRIMARY KEY(_id));
+CREATE TABLE T_Alt_t (name TEXT NOT NULL, value TEXT NOT NULL, _id INT NOT NULL, PRIMARY KEY(name, value, _id));
+CREATE INDEX I_Alt_t_value ON T_Alt_t (value);
+CREATE INDEX I_Alt_t_id ON T_Alt_t (_id);
+INSERT INTO T_Main_t VALUES ('1', 'abc', '"one"');
+INSERT INTO T_Alt_t VALUES ('name', 'x', '1');
+`)
+	c.Assert(err, IsNil)
+	db.Close()
+
+	drv, kerr := NewDriver().Configure("db", Dictionary{"dsn": this.path})
+	c.Assert(kerr, IsNil)
+	defer drv.Drop()
+	names, kerr := drv.ListTables()
+	c.Assert(kerr, IsNil)
+	c.Check(names, DeepEquals, []string{"t"})
+
+	pool := drv.(*Database).db
+	var version int
+	c.Assert(pool.QueryRow("PRAGMA user_version").Scan(&version), IsNil)
+	c.Check(version, Equals, len(migrations))
+	var kind string
+	c.Assert(pool.QueryRow("SELECT typeof(_id) FROM T_Main_t").Scan(&kind), IsNil)
+	c.Check(kind, Equals, "text")
+
+	table, kerr := drv.GetTable("t", false)
+	c.Assert(kerr, IsNil)
+	ch, kerr := table.Get(context.Background(), NewQueryEQ("name", "x", 10))
+	c.Assert(kerr, IsNil)
+	record := <-ch
+	c.Assert(record, NotNil)
+	c.Check(record.Id, Equals, "1")
+	c.Check(record.Doc, Equals, "one")
+	_, kerr = table.Put(&Record{Id: "01", Doc: "zero one"})
+	c.Check(kerr, IsNil)
+	_, kerr = table.Delete("1", record.Rev)
+	c.Check(kerr, IsNil)
+
+	changes, kerr := table.Changes(context.Background(), 0)
+	c.Assert(kerr, IsNil)
+	ids := []string{}
+	for change := range changes {
+		ids = append(ids, change.Id)
+	}
+	c.Check(ids, DeepEquals, []string{"01", "1"})
+}
@@ -0,0 +1,223 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/flaub/ergo"
+	. "github.com/flaub/kissdif"
+	"github.com/flaub/kissdif/driver"
+	"sync"
+	"time"
+)
+
+// Tx maps a transaction onto a sqlite transaction. Each write gets a
+// savepoint of its own so that a failed write can be undone alone.
+type Tx struct {
+	db      *Database
+	tx      *sql.Tx
+	created map[string]*Table // tables created by the transaction
+	changed map[*Table]bool   // tables written
+	done    bool
+	mutex   sync.Mutex
+}
+
+func (this *Database) Begin() (driver.Tx, *ergo.Error) {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	return &Tx{
+		db:      this,
+		tx:      tx,
+		created: make(map[string]*Table),
+		changed: make(map[*Table]bool),
+	}, nil
+}
+
+// table returns the named table, creating it within the transaction if
+// create is set.
+func (this *Tx) table(name string, create bool) (*Table, *ergo.Error) {
+	table, ok := this.created[name]
+	if ok {
+		return table, nil
+	}
+	this.db.mutex.RLock()
+	table, ok = this.db.tables[name]
+	this.db.mutex.RUnlock()
+	if ok {
+		return table, nil
+	}
+	if !create {
+		return nil, NewError(EBadTable, "name", name)
+	}
+	_, err := this.tx.Exec(compile(sqlSchema, name, ""))
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	table = newTable(this.db, name)
+	this.created[name] = table
+	return table, nil
+}
+
+func (this *Tx) Get(ctx context.Context, name string, query *Query) (chan (*Record), *ergo.Error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return nil, NewError(EBadTx)
+	}
+	table, kerr := this.table(name, false)
+	if kerr != nil {
+		return nil, kerr
+	}
+	text, where, order, args, kerr := table.compileQuery(query)
+	if kerr != nil {
+		return nil, kerr
+	}
+	rows, err := this.tx.QueryContext(ctx, compileOrdered(text, name, where, order), args...)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	// read everything now, so that the rows are closed before the
+	// transaction's connection is used again
+	records, more, kerr := scan(rows, query.Limit)
+	if kerr != nil {
+		return nil, kerr
+	}
+	if !more {
+		records = append(records, nil)
+	}
+	ch := make(chan (*Record), len(records))
+	for _, record := range records {
+		ch <- record
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (this *Tx) Put(name string, record *Record) (string, *ergo.Error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return "", NewError(EBadTx)
+	}
+	table, kerr := this.table(name, true)
+	if kerr != nil {
+		return "", kerr
+	}
+	rev, kerr := this.write(func() (string, *ergo.Error) {
+		return table.put(this.tx, record)
+	})
+	if kerr != nil {
+		return "", kerr
+	}
+	this.changed[table] = true
+	record.Rev = rev
+	return rev, nil
+}
+
+func (this *Tx) Delete(name, id, rev string) (string, *ergo.Error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return "", NewError(EBadTx)
+	}
+	table, kerr := this.table(name, false)
+	if kerr != nil {
+		return "", kerr
+	}
+	tombRev, kerr := this.write(func() (string, *ergo.Error) {
+		return table.delete(this.tx, id, rev, time.Now())
+	})
+	if kerr != nil {
+		return "", kerr
+	}
+	if tombRev != "" {
+		this.changed[table] = true
+	}
+	return tombRev, nil
+}
+
+// write runs fn under a savepoint, which is rolled back if fn fails.
+func (this *Tx) write(fn func() (string, *ergo.Error)) (string, *ergo.Error) {
+	_, err := this.tx.Exec("SAVEPOINT write")
+	if err != nil {
+		return "", Wrap(err)
+	}
+	rev, kerr := fn()
+	if kerr != nil {
+		_, err = this.tx.Exec("ROLLBACK TO write")
+		if err != nil {
+			return "", Wrap(err)
+		}
+		rev = ""
+	}
+	_, err = this.tx.Exec("RELEASE write")
+	if err != nil {
+		return "", Wrap(err)
+	}
+	return rev, kerr
+}
+
+func (this *Tx) Commit() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return NewError(EBadTx)
+	}
+	this.done = true
+	now := time.Now()
+	for table := range this.changed {
+		err := table.compact(this.tx, now)
+		if err != nil {
+			this.tx.Rollback()
+			return Wrap(err)
+		}
+	}
+	err := this.tx.Commit()
+	if err != nil {
+		return Wrap(err)
+	}
+	kerr := this.register()
+	for table := range this.changed {
+		this.db.mutex.RLock()
+		current := this.db.tables[table.name]
+		this.db.mutex.RUnlock()
+		if current != nil {
+			current.notify()
+		}
+	}
+	return kerr
+}
+
+// register adds the tables created by the transaction to the database,
+// unless another transaction got there first.
+func (this *Tx) register() *ergo.Error {
+	this.db.mutex.Lock()
+	defer this.db.mutex.Unlock()
+	for name, table := range this.created {
+		_, ok := this.db.tables[name]
+		if ok {
+			continue
+		}
+		err := table.prepareAll()
+		if err != nil {
+			return Wrap(err)
+		}
+		this.db.tables[name] = table
+	}
+	return nil
+}
+
+func (this *Tx) Rollback() *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.done {
+		return NewError(EBadTx)
+	}
+	this.done = true
+	err := this.tx.Rollback()
+	if err != nil {
+		return Wrap(err)
+	}
+	return nil
+}
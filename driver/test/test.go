@@ -1,9 +1,14 @@
 package test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/flaub/ergo"
 	. "github.com/flaub/kissdif"
 	. "github.com/flaub/kissdif/driver"
 	. "github.com/motain/gocheck"
+	"time"
 )
 
 type TestSuite struct {
@@ -43,6 +48,12 @@ func (this *TestSuite) putRecordFull(id, rev, value string, keys IndexMap) strin
 	return rev
 }
 
+func (this *TestSuite) deleteRecord(id, rev string) string {
+	rev, err := this.table.Delete(id, rev)
+	this.c.Assert(err, IsNil, Commentf("Id: %v", id))
+	return rev
+}
+
 // mb = make bound
 func mb(value string, inclusive bool) Bound {
 	return Bound{inclusive, value}
@@ -58,7 +69,7 @@ func (this *TestSuite) expect(test expectedQuery, expectedEof bool, limit uint)
 		Lower: test.lower,
 		Upper: test.upper,
 	}
-	ch, err := this.table.Get(query)
+	ch, err := this.table.Get(context.Background(), query)
 	this.c.Assert(err, IsNil)
 	actual := []string{}
 	eof := false
@@ -93,11 +104,11 @@ func (this *TestSuite) SetUpTest(c *C) {
 func (this *TestSuite) TestBasic(c *C) {
 	this.c = c
 	query := &Query{}
-	_, err := this.table.Get(query)
+	_, err := this.table.Get(context.Background(), query)
 	c.Assert(err.Code, Equals, EBadIndex)
 
 	query.Index = "_id"
-	_, err = this.table.Get(query)
+	_, err = this.table.Get(context.Background(), query)
 	c.Assert(err.Code, Equals, EBadParam)
 
 	query.Limit = 10
@@ -285,22 +296,49 @@ func (this *TestSuite) TestLimit(c *C) {
 
 func (this *TestSuite) TestDelete(c *C) {
 	this.c = c
-	this.putValues("a", "b")
-	this.putRecord("c", IndexMap{
+	revA := this.putRecord("a", IndexMap{})
+	revB := this.putRecord("b", IndexMap{})
+	revC := this.putRecord("c", IndexMap{
 		"x": []string{"x"},
 	})
-	this.c.Assert(this.table.Delete("a"), IsNil)
+	this.deleteRecord("a", revA)
 	this.query(true, 10, []expectedQuery{
 		{"_id", ob, ob, []string{"b", "c"}},
 		{"x", ob, ob, []string{"c"}},
 	})
-	this.c.Assert(this.table.Delete("a"), IsNil)
-	this.c.Assert(this.table.Delete("b"), IsNil)
+	this.deleteRecord("a", revA)
+	this.deleteRecord("b", revB)
 	this.query(true, 10, []expectedQuery{
 		{"_id", ob, ob, []string{"c"}},
 		{"x", ob, ob, []string{"c"}},
 	})
-	this.c.Assert(this.table.Delete("c"), IsNil)
+	this.deleteRecord("c", revC)
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{}},
+		{"x", ob, ob, []string{}},
+	})
+}
+
+func (this *TestSuite) TestDeleteConflict(c *C) {
+	this.c = c
+	rev := this.putRecord("a", IndexMap{
+		"x": []string{"x"},
+	})
+
+	_, err := this.table.Delete("a", "")
+	this.c.Assert(err, NotNil)
+	this.c.Assert(err.Code, Equals, EConflict)
+
+	_, err = this.table.Delete("a", "xxx")
+	this.c.Assert(err, NotNil)
+	this.c.Assert(err.Code, Equals, EConflict)
+
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"a"}},
+		{"x", ob, ob, []string{"a"}},
+	})
+
+	this.deleteRecord("a", rev)
 	this.query(true, 10, []expectedQuery{
 		{"_id", ob, ob, []string{}},
 		{"x", ob, ob, []string{}},
@@ -321,16 +359,31 @@ func (this *TestSuite) TestMVCC(c *C) {
 	this.c.Assert(err, NotNil)
 	this.c.Assert(err.Code, Equals, EConflict)
 
+	gen, _, err := ParseRevision(prev)
+	this.c.Assert(err, IsNil)
+	this.c.Assert(gen, Equals, uint64(1))
+
+	// rewriting the same document still produces a newer revision
 	record = &Record{Id: "a", Rev: prev, Doc: "a"}
 	cur, err = this.table.Put(record)
 	this.c.Assert(err, IsNil)
-	this.c.Assert(cur, Equals, prev)
+	this.c.Assert(cur, Not(Equals), prev)
+	this.c.Assert(CompareRevisions(cur, prev), Equals, 1)
+
+	record = &Record{Id: "a", Rev: prev, Doc: "a"}
+	_, err = this.table.Put(record)
+	this.c.Assert(err, NotNil)
+	this.c.Assert(err.Code, Equals, EConflict)
 
 	prev = cur
 	record = &Record{Id: "a", Rev: cur, Doc: "b"}
 	cur, err = this.table.Put(record)
 	this.c.Assert(err, IsNil)
 	this.c.Assert(cur, Not(Equals), prev)
+	gen, _, err = ParseRevision(cur)
+	this.c.Assert(err, IsNil)
+	this.c.Assert(gen, Equals, uint64(3))
+	this.c.Assert(CompareRevisions(prev, cur), Equals, -1)
 
 	record = &Record{Id: "a", Rev: "xxx", Doc: "b"}
 	cur, err = this.table.Put(record)
@@ -338,3 +391,775 @@ func (this *TestSuite) TestMVCC(c *C) {
 	this.c.Assert(err, NotNil)
 	this.c.Assert(err.Code, Equals, EConflict)
 }
+
+func (this *TestSuite) TestDrop(c *C) {
+	this.c = c
+	this.putValues("a", "b")
+	c.Assert(this.db.Drop(), IsNil)
+	_, err := this.db.GetTable("table", false)
+	c.Assert(err, NotNil)
+	c.Assert(err.Code, Equals, EBadTable)
+}
+
+func (this *TestSuite) TestDropTable(c *C) {
+	this.c = c
+	this.putRecord("a", IndexMap{
+		"x": []string{"a_x"},
+	})
+	stale := this.table
+	c.Assert(this.db.DropTable("table"), IsNil)
+	_, err := this.db.GetTable("table", false)
+	c.Assert(err, NotNil)
+	c.Assert(err.Code, Equals, EBadTable)
+
+	err = this.db.DropTable("table")
+	c.Assert(err, NotNil)
+	c.Assert(err.Code, Equals, EBadTable)
+
+	this.table, err = this.db.GetTable("table", true)
+	c.Assert(err, IsNil)
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{}},
+	})
+	this.putRecord("a", IndexMap{})
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"a"}},
+	})
+
+	// a handle on the dropped table doesn't reach the new one
+	_, err = stale.Put(&Record{Id: "b", Doc: "b"})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadTable)
+	_, err = stale.Delete("a", "")
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadTable)
+	c.Check(stale.DefineIndex(&IndexDef{Name: "x", Path: "/x"}).Code, Equals, EBadTable)
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"a"}},
+	})
+}
+
+func (this *TestSuite) TestCatalog(c *C) {
+	this.c = c
+	_, err := this.db.GetTable("other", true)
+	c.Assert(err, IsNil)
+	tables, err := this.db.ListTables()
+	c.Assert(err, IsNil)
+	c.Assert(tables, DeepEquals, []string{"other", "table"})
+
+	indexes, err := this.table.ListIndexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, DeepEquals, []string{"_id"})
+
+	this.putRecord("a", IndexMap{
+		"y": []string{"a_y"},
+		"x": []string{"a_x"},
+	})
+	indexes, err = this.table.ListIndexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, DeepEquals, []string{"_id", "x", "y"})
+}
+
+func (this *TestSuite) page(query *Query) ([]string, bool, string) {
+	ch, err := this.table.Get(context.Background(), query)
+	this.c.Assert(err, IsNil)
+	actual := []string{}
+	eof := false
+	cursor := ""
+	for record := range ch {
+		if record == nil {
+			eof = true
+		} else {
+			actual = append(actual, record.Doc.(string))
+			cursor = record.Cursor
+		}
+	}
+	return actual, eof, cursor
+}
+
+func (this *TestSuite) TestCursor(c *C) {
+	this.c = c
+	for _, id := range []string{"e", "d", "c", "b", "a"} {
+		this.putRecord(id, IndexMap{
+			"x": []string{"same"},
+		})
+	}
+	this.putRecord("f", IndexMap{
+		"x": []string{"zzz"},
+	})
+
+	for _, index := range []string{"_id", "x"} {
+		query := &Query{Index: index, Limit: 2}
+		actual := []string{}
+		pages := 0
+		for {
+			records, eof, cursor := this.page(query)
+			actual = append(actual, records...)
+			pages++
+			if eof {
+				break
+			}
+			c.Assert(cursor, Not(Equals), "")
+			query.After = cursor
+		}
+		c.Check(actual, DeepEquals, []string{"a", "b", "c", "d", "e", "f"}, Commentf("Index: %v", index))
+		c.Check(pages, Equals, 3, Commentf("Index: %v", index))
+	}
+
+	query := &Query{Index: "x", Lower: mb("same", true), Upper: mb("same", true), Limit: 3}
+	records, eof, cursor := this.page(query)
+	c.Check(records, DeepEquals, []string{"a", "b", "c"})
+	c.Check(eof, Equals, false)
+	query.After = cursor
+	records, eof, _ = this.page(query)
+	c.Check(records, DeepEquals, []string{"d", "e"})
+	c.Check(eof, Equals, true)
+
+	query = &Query{Index: "x", Limit: 3, After: "bogus"}
+	_, err := this.table.Get(context.Background(), query)
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadParam)
+}
+
+func (this *TestSuite) TestDescending(c *C) {
+	this.c = c
+	this.putValues("b", "c", "d")
+	this.putRecord("x1", IndexMap{"x": []string{"same"}})
+	this.putRecord("x2", IndexMap{"x": []string{"same"}})
+	this.putRecord("x3", IndexMap{"x": []string{"other"}})
+
+	tests := []expectedQuery{
+		{"_id", ob, ob, []string{"x3", "x2", "x1", "d", "c", "b"}},
+		{"_id", mb("a", true), mb("e", true), []string{"d", "c", "b"}},
+		{"_id", mb("b", false), mb("d", false), []string{"c"}},
+		{"_id", mb("b", true), mb("d", true), []string{"d", "c", "b"}},
+		{"_id", mb("c", true), mb("c", true), []string{"c"}},
+		{"_id", ob, mb("c", true), []string{"c", "b"}},
+		{"_id", ob, mb("cc", true), []string{"c", "b"}},
+		{"_id", mb("c", false), ob, []string{"x3", "x2", "x1", "d"}},
+		{"x", ob, ob, []string{"x2", "x1", "x3"}},
+		{"x", mb("same", true), mb("same", true), []string{"x2", "x1"}},
+	}
+	for _, test := range tests {
+		query := &Query{
+			Index:      test.index,
+			Lower:      test.lower,
+			Upper:      test.upper,
+			Limit:      10,
+			Descending: true,
+		}
+		actual, eof, _ := this.page(query)
+		c.Check(actual, DeepEquals, test.expected, Commentf("Query: %v", query))
+		c.Check(eof, Equals, true, Commentf("Query: %v", query))
+	}
+
+	query := &Query{Index: "x", Limit: 1, Descending: true}
+	actual := []string{}
+	for {
+		records, eof, cursor := this.page(query)
+		actual = append(actual, records...)
+		if eof {
+			break
+		}
+		query.After = cursor
+	}
+	c.Check(actual, DeepEquals, []string{"x2", "x1", "x3"})
+}
+
+func (this *TestSuite) changes(since uint64) []Change {
+	ch, err := this.table.Changes(context.Background(), since)
+	this.c.Assert(err, IsNil)
+	changes := []Change{}
+	for change := range ch {
+		changes = append(changes, *change)
+	}
+	return changes
+}
+
+func (this *TestSuite) TestChanges(c *C) {
+	this.c = c
+	c.Check(this.changes(0), HasLen, 0)
+
+	revA := this.putRecord("a", IndexMap{})
+	revB := this.putRecord("b", IndexMap{})
+	revC := this.putRecord("c", IndexMap{})
+	revA2 := this.putRecordFull("a", revA, "a", IndexMap{})
+	tombB := this.deleteRecord("b", revB)
+
+	changes := this.changes(0)
+	c.Assert(changes, HasLen, 3)
+	c.Check(changes[0], Equals, Change{Seq: 3, Id: "c", Rev: revC})
+	c.Check(changes[1], Equals, Change{Seq: 4, Id: "a", Rev: revA2})
+	c.Check(changes[2], Equals, Change{Seq: 5, Id: "b", Rev: tombB, Deleted: true})
+
+	c.Check(this.changes(3), DeepEquals, changes[1:])
+	c.Check(this.changes(5), HasLen, 0)
+
+	// deleting a missing or deleted record is not a change
+	c.Check(this.deleteRecord("x", ""), Equals, "")
+	c.Check(this.deleteRecord("b", tombB), Equals, "")
+	c.Check(this.changes(5), HasLen, 0)
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *TestSuite) TestWatch(c *C) {
+	this.c = c
+	watch, err := this.table.Watch(0)
+	c.Assert(err, IsNil)
+	c.Check(isClosed(watch), Equals, false)
+
+	this.putValues("a")
+	c.Check(isClosed(watch), Equals, true)
+	watch, err = this.table.Watch(0)
+	c.Assert(err, IsNil)
+	c.Check(isClosed(watch), Equals, true)
+	watch, err = this.table.Watch(1)
+	c.Assert(err, IsNil)
+	c.Check(isClosed(watch), Equals, false)
+
+	result, err := WaitChanges(context.Background(), this.table, 1, time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Check(result.Changes, HasLen, 0)
+	c.Check(result.LastSeq, Equals, uint64(1))
+
+	done := make(chan *ChangeSet)
+	go func() {
+		result, _ := WaitChanges(context.Background(), this.table, 1, 10*time.Second)
+		done <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+	this.putValues("b")
+	result = <-done
+	c.Assert(result, NotNil)
+	c.Assert(result.Changes, HasLen, 1)
+	c.Check(result.Changes[0].Id, Equals, "b")
+	c.Check(result.LastSeq, Equals, uint64(2))
+}
+
+// TestCancel checks that abandoned queries let go of the table once their
+// context is cancelled.
+func (this *TestSuite) TestCancel(c *C) {
+	this.c = c
+	this.putValues("a", "b", "c")
+	put := func(id string) {
+		done := make(chan *ergo.Error, 1)
+		go func() {
+			_, err := this.table.Put(&Record{Id: id, Doc: id})
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			c.Check(err, IsNil)
+		case <-time.After(5 * time.Second):
+			c.Fatal("write blocked by a cancelled query")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := this.table.Get(ctx, &Query{Index: "_id", Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(<-ch, NotNil)
+	cancel()
+	put("d")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	changes, err := this.table.Changes(ctx, 0)
+	c.Assert(err, IsNil)
+	c.Assert(<-changes, NotNil)
+	cancel()
+	put("e")
+}
+
+// TestWriteWhileReading checks that an open query leaves the table free to
+// be written to, and that it reads on past the write a page at a time.
+func (this *TestSuite) TestWriteWhileReading(c *C) {
+	this.c = c
+	ids := []string{}
+	for i := 0; i < PageSize+10; i++ {
+		ids = append(ids, fmt.Sprintf("%03d", i))
+	}
+	this.putValues(ids...)
+
+	ch, err := this.table.Get(context.Background(), &Query{Index: "_id", Limit: 1000})
+	c.Assert(err, IsNil)
+	first := <-ch
+	c.Assert(first, NotNil)
+	done := make(chan *ergo.Error, 1)
+	go func() {
+		_, err := this.table.Put(&Record{Id: first.Id, Rev: first.Rev, Doc: "x"})
+		if err == nil {
+			_, err = this.table.Put(&Record{Id: "zzz", Doc: "zzz"})
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		c.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("write blocked by an open query")
+	}
+	c.Check(this.ids(ch), DeepEquals, append(ids[1:], "zzz"))
+}
+
+func (this *TestSuite) TestWriteWhileWatching(c *C) {
+	this.c = c
+	this.putValues("a", "b")
+
+	ch, err := this.table.Changes(context.Background(), 0)
+	c.Assert(err, IsNil)
+	first := <-ch
+	c.Assert(first, NotNil)
+	done := make(chan *ergo.Error, 1)
+	go func() {
+		_, err := this.table.Put(&Record{Id: "c", Doc: "c"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		c.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("write blocked by an open changes feed")
+	}
+	ids := []string{first.Id}
+	for change := range ch {
+		ids = append(ids, change.Id)
+	}
+	c.Check(ids, DeepEquals, []string{"a", "b"})
+}
+
+func (this *TestSuite) TestTombstones(c *C) {
+	this.c = c
+	rev := this.putRecord("a", IndexMap{"x": {"x"}})
+	this.putValues("b")
+	tomb := this.deleteRecord("a", rev)
+	c.Assert(tomb, Not(Equals), "")
+	c.Check(CompareRevisions(tomb, rev), Equals, 1)
+
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"b"}},
+		{"x", ob, ob, []string{}},
+	})
+
+	query := NewQueryEQ("_id", "a", 10)
+	query.Deleted = true
+	ch, err := this.table.Get(context.Background(), query)
+	c.Assert(err, IsNil)
+	record := <-ch
+	c.Assert(record, NotNil)
+	c.Check(record.Rev, Equals, tomb)
+	c.Check(record.Deleted, Equals, true)
+	c.Check(record.Doc, IsNil)
+	c.Check(<-ch, IsNil)
+
+	query = &Query{Index: "_id", Limit: 1, Deleted: true}
+	ch, err = this.table.Get(context.Background(), query)
+	c.Assert(err, IsNil)
+	record = <-ch
+	c.Assert(record, NotNil)
+	c.Check(record.Id, Equals, "a")
+	_, ok := <-ch
+	c.Check(ok, Equals, false)
+
+	// a tombstone can be replaced with or without its revision
+	rev = this.putRecordFull("a", "", "a2", IndexMap{})
+	gen, _, err := ParseRevision(rev)
+	c.Assert(err, IsNil)
+	c.Check(gen, Equals, uint64(3))
+	tomb = this.deleteRecord("a", rev)
+	this.putRecordFull("a", tomb, "a3", IndexMap{})
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"a3", "b"}},
+	})
+}
+
+func (this *TestSuite) TestCompaction(c *C) {
+	this.c = c
+	drv, err := Open(this.name)
+	c.Assert(err, IsNil)
+	config := Dictionary{"tombstone_max": "x"}
+	_, err = drv.Configure("db", config)
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EBadParam)
+
+	config = Dictionary{"tombstone_max": "1"}
+	for k, v := range this.Config {
+		config[k] = v
+	}
+	db, err := drv.Configure("db", config)
+	c.Assert(err, IsNil)
+	this.table, err = db.GetTable("compact", true)
+	c.Assert(err, IsNil)
+	revA := this.putRecord("a", IndexMap{})
+	revB := this.putRecord("b", IndexMap{})
+	this.deleteRecord("a", revA)
+	tombB := this.deleteRecord("b", revB)
+
+	query := &Query{Index: "_id", Limit: 10, Deleted: true}
+	ch, err := this.table.Get(context.Background(), query)
+	c.Assert(err, IsNil)
+	ids := []string{}
+	for record := range ch {
+		if record != nil {
+			ids = append(ids, record.Id)
+		}
+	}
+	c.Check(ids, DeepEquals, []string{"b"})
+	c.Check(this.changes(0), DeepEquals, []Change{{Seq: 4, Id: "b", Rev: tombB, Deleted: true}})
+}
+
+// TestCompactionTTL checks that expired tombstones are purged by any later
+// write, not only by another delete.
+func (this *TestSuite) TestCompactionTTL(c *C) {
+	this.c = c
+	drv, err := Open(this.name)
+	c.Assert(err, IsNil)
+	config := Dictionary{"tombstone_ttl": "50ms"}
+	for k, v := range this.Config {
+		config[k] = v
+	}
+	db, err := drv.Configure("db", config)
+	c.Assert(err, IsNil)
+	this.table, err = db.GetTable("compact", true)
+	c.Assert(err, IsNil)
+	revA := this.putRecord("a", IndexMap{})
+	this.deleteRecord("a", revA)
+	time.Sleep(100 * time.Millisecond)
+	revB := this.putRecord("b", IndexMap{})
+
+	ch, err := this.table.Get(context.Background(), &Query{Index: "_id", Limit: 10, Deleted: true})
+	c.Assert(err, IsNil)
+	c.Check(this.ids(ch), DeepEquals, []string{"b"})
+	c.Check(this.changes(0), DeepEquals, []Change{{Seq: 3, Id: "b", Rev: revB}})
+}
+
+func (this *TestSuite) TestPutMany(c *C) {
+	this.c = c
+	revA := this.putRecord("a", IndexMap{})
+	results, err := this.table.PutMany([]*Record{
+		{Id: "b", Doc: "b", Keys: IndexMap{"x": {"x"}}},
+		{Id: "a", Rev: revA, Deleted: true},
+		{Id: "c", Doc: "c"},
+		{Id: "d", Deleted: true},
+	}, true)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 4)
+	c.Check(results[0].Id, Equals, "b")
+	c.Check(results[0].Rev, Not(Equals), "")
+	c.Check(CompareRevisions(results[1].Rev, revA), Equals, 1)
+	c.Check(results[3].Rev, Equals, "")
+	for _, result := range results {
+		c.Check(result.Error, IsNil)
+	}
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"b", "c"}},
+		{"x", ob, ob, []string{"b"}},
+	})
+	c.Check(this.changes(1), HasLen, 3)
+
+	// a conflict leaves the whole batch unwritten
+	_, err = this.table.PutMany([]*Record{
+		{Id: "e", Doc: "e"},
+		{Id: "b", Doc: "b2"},
+	}, true)
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"b", "c"}},
+	})
+
+	// unless each record is written on its own
+	results, err = this.table.PutMany([]*Record{
+		{Id: "e", Doc: "e"},
+		{Id: "b", Doc: "b2"},
+		{Id: "c", Rev: results[2].Rev, Doc: "c2"},
+	}, false)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	c.Check(results[0].Error, IsNil)
+	c.Assert(results[1].Error, NotNil)
+	c.Check(results[1].Error.Code, Equals, EConflict)
+	c.Check(results[1].Rev, Equals, "")
+	c.Check(results[2].Error, IsNil)
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"b", "c2", "e"}},
+	})
+
+	// later records see the earlier ones
+	_, err = this.table.PutMany([]*Record{
+		{Id: "f", Doc: "f"},
+		{Id: "f", Doc: "f2"},
+	}, true)
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+	results, err = this.table.PutMany([]*Record{
+		{Id: "f", Doc: "f"},
+		{Id: "f", Rev: "", Deleted: true},
+	}, false)
+	c.Assert(err, IsNil)
+	c.Check(results[0].Error, IsNil)
+	c.Check(results[1].Error, NotNil)
+}
+
+func (this *TestSuite) docs(ch chan (*Record)) ([]string, bool) {
+	docs := []string{}
+	eof := false
+	for record := range ch {
+		if record == nil {
+			eof = true
+		} else {
+			docs = append(docs, record.Doc.(string))
+		}
+	}
+	return docs, eof
+}
+
+func (this *TestSuite) TestTx(c *C) {
+	this.c = c
+	revA := this.putRecord("a", IndexMap{})
+	revB := this.putRecord("b", IndexMap{"x": {"1"}})
+	this.putRecord("d", IndexMap{"x": {"3"}})
+
+	tx, err := this.db.Begin()
+	c.Assert(err, IsNil)
+	tomb, err := tx.Delete("table", "a", revA)
+	c.Assert(err, IsNil)
+	c.Check(CompareRevisions(tomb, revA), Equals, 1)
+	_, err = tx.Put("table", &Record{Id: "b", Rev: revB, Doc: "b2", Keys: IndexMap{"x": {"4"}}})
+	c.Assert(err, IsNil)
+	_, err = tx.Put("table", &Record{Id: "c", Doc: "c", Keys: IndexMap{"x": {"2"}}})
+	c.Assert(err, IsNil)
+	_, err = tx.Put("other", &Record{Id: "o", Doc: "o"})
+	c.Assert(err, IsNil)
+	_, err = tx.Delete("missing", "a", "")
+	c.Check(err.Code, Equals, EBadTable)
+
+	// a failed write leaves the transaction as it was
+	_, err = tx.Put("table", &Record{Id: "b", Doc: "b3"})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+
+	// reads see the transaction's own writes
+	ch, err := tx.Get(context.Background(), "table", &Query{Index: "_id", Limit: 10})
+	c.Assert(err, IsNil)
+	docs, eof := this.docs(ch)
+	c.Check(docs, DeepEquals, []string{"b2", "c", "d"})
+	c.Check(eof, Equals, true)
+	ch, err = tx.Get(context.Background(), "table", &Query{Index: "x", Limit: 2})
+	c.Assert(err, IsNil)
+	docs, eof = this.docs(ch)
+	c.Check(docs, DeepEquals, []string{"c", "d"})
+	c.Check(eof, Equals, false)
+	ch, err = tx.Get(context.Background(), "table", &Query{Index: "x", Limit: 2, Descending: true})
+	c.Assert(err, IsNil)
+	docs, _ = this.docs(ch)
+	c.Check(docs, DeepEquals, []string{"b2", "d"})
+	ch, err = tx.Get(context.Background(), "other", NewQueryEQ("_id", "o", 1))
+	c.Assert(err, IsNil)
+	docs, _ = this.docs(ch)
+	c.Check(docs, DeepEquals, []string{"o"})
+	_, err = tx.Get(context.Background(), "missing", NewQueryEQ("_id", "o", 1))
+	c.Check(err.Code, Equals, EBadTable)
+
+	c.Assert(tx.Commit(), IsNil)
+	c.Check(tx.Commit().Code, Equals, EBadTx)
+	_, err = tx.Put("table", &Record{Id: "e", Doc: "e"})
+	c.Check(err.Code, Equals, EBadTx)
+
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"b2", "c", "d"}},
+		{"x", ob, ob, []string{"c", "d", "b2"}},
+	})
+	c.Check(this.changes(3), HasLen, 3)
+	other, err := this.db.GetTable("other", false)
+	c.Assert(err, IsNil)
+	ch, err = other.Get(context.Background(), NewQueryEQ("_id", "o", 1))
+	c.Assert(err, IsNil)
+	docs, _ = this.docs(ch)
+	c.Check(docs, DeepEquals, []string{"o"})
+
+	tx, err = this.db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Put("table", &Record{Id: "e", Doc: "e"})
+	c.Assert(err, IsNil)
+	c.Assert(tx.Rollback(), IsNil)
+	c.Check(tx.Rollback().Code, Equals, EBadTx)
+	this.query(true, 10, []expectedQuery{
+		{"_id", ob, ob, []string{"b2", "c", "d"}},
+	})
+}
+
+func (this *TestSuite) ids(ch chan (*Record)) []string {
+	ids := []string{}
+	for record := range ch {
+		if record != nil {
+			ids = append(ids, record.Id)
+		}
+	}
+	return ids
+}
+
+func (this *TestSuite) lookup(index, key string) []string {
+	ch, err := this.table.Get(context.Background(), NewQueryEQ(index, key, 10))
+	this.c.Assert(err, IsNil)
+	return this.ids(ch)
+}
+
+func (this *TestSuite) TestComputedIndex(c *C) {
+	this.c = c
+	doc := func(fields ...interface{}) map[string]interface{} {
+		result := make(map[string]interface{})
+		for i := 0; i < len(fields); i += 2 {
+			result[fields[i].(string)] = fields[i+1]
+		}
+		return result
+	}
+	revA, err := this.table.Put(&Record{
+		Id:   "a",
+		Doc:  doc("email", "a@x", "tags", []string{"t1", "t2", "t1"}),
+		Keys: IndexMap{"email": {"bogus"}},
+	})
+	c.Assert(err, IsNil)
+	_, err = this.table.Put(&Record{Id: "b", Doc: doc("email", "b@x", "n", 2)})
+	c.Assert(err, IsNil)
+	_, err = this.table.Put(&Record{Id: "c", Doc: doc("name", "c")})
+	c.Assert(err, IsNil)
+
+	c.Check(this.table.DefineIndex(&IndexDef{Name: "_id", Path: "/id"}).Code, Equals, EBadParam)
+	c.Check(this.table.DefineIndex(&IndexDef{Name: "_deleted", Path: "/id"}).Code, Equals, EBadParam)
+	c.Check(this.table.DefineIndex(&IndexDef{Name: "x", Path: "x"}).Code, Equals, EBadParam)
+
+	// existing records are indexed, replacing the keys they were put with
+	c.Assert(this.table.DefineIndex(&IndexDef{Name: "email", Path: "/email"}), IsNil)
+	c.Assert(this.table.DefineIndex(&IndexDef{Name: "tags", Path: "/tags"}), IsNil)
+	c.Assert(this.table.DefineIndex(&IndexDef{Name: "n", Path: "/n"}), IsNil)
+	c.Check(this.lookup("email", "a@x"), DeepEquals, []string{"a"})
+	c.Check(this.lookup("email", "bogus"), DeepEquals, []string{})
+	c.Check(this.lookup("tags", "t1"), DeepEquals, []string{"a"})
+	c.Check(this.lookup("n", "2"), DeepEquals, []string{"b"})
+
+	// numbers are keyed alike however they are written
+	_, err = this.table.Put(&Record{Id: "f", Doc: json.RawMessage(`{"n": 2.0}`)})
+	c.Assert(err, IsNil)
+	_, err = this.table.Put(&Record{Id: "g", Doc: json.RawMessage(`{"n": [1e2, 2.50]}`)})
+	c.Assert(err, IsNil)
+	c.Check(this.lookup("n", "2"), DeepEquals, []string{"b", "f"})
+	c.Check(this.lookup("n", "100"), DeepEquals, []string{"g"})
+	c.Check(this.lookup("n", "2.5"), DeepEquals, []string{"g"})
+	query := &Query{Index: "email", Limit: 10}
+	this.expectIds(query, "a", "b")
+
+	// and so are the records put afterwards
+	_, err = this.table.Put(&Record{
+		Id:   "a",
+		Rev:  revA,
+		Doc:  doc("email", "z@x", "tags", []string{"t2"}),
+		Keys: IndexMap{"email": {"manual"}, "other": {"o"}},
+	})
+	c.Assert(err, IsNil)
+	_, err = this.table.Put(&Record{Id: "d", Doc: doc("email", "d@x", "tags", []string{"t2"})})
+	c.Assert(err, IsNil)
+	c.Check(this.lookup("email", "z@x"), DeepEquals, []string{"a"})
+	c.Check(this.lookup("email", "manual"), DeepEquals, []string{})
+	c.Check(this.lookup("other", "o"), DeepEquals, []string{"a"})
+	c.Check(this.lookup("tags", "t1"), DeepEquals, []string{})
+	c.Check(this.lookup("tags", "t2"), DeepEquals, []string{"a", "d"})
+
+	tx, err := this.db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Put("table", &Record{Id: "e", Doc: doc("email", "e@x")})
+	c.Assert(err, IsNil)
+	c.Assert(tx.Commit(), IsNil)
+	this.expectIds(query, "b", "d", "e", "a")
+
+	defs, err := this.table.ListIndexDefs()
+	c.Assert(err, IsNil)
+	c.Check(defs, DeepEquals, []*IndexDef{
+		{Name: "email", Path: "/email"},
+		{Name: "n", Path: "/n"},
+		{Name: "tags", Path: "/tags"},
+	})
+	names, err := this.table.ListIndexes()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"_id", "email", "n", "other", "tags"})
+}
+
+func (this *TestSuite) TestUniqueIndex(c *C) {
+	this.c = c
+	email := func(value string) map[string]interface{} {
+		return map[string]interface{}{"email": value}
+	}
+	unique := &IndexDef{Name: "email", Path: "/email", Unique: true}
+	_, err := this.table.Put(&Record{Id: "a", Doc: email("a@x")})
+	c.Assert(err, IsNil)
+	revB, err := this.table.Put(&Record{Id: "b", Doc: email("a@x")})
+	c.Assert(err, IsNil)
+
+	// an index can't be made unique while records share a key
+	err = this.table.DefineIndex(unique)
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+	defs, err := this.table.ListIndexDefs()
+	c.Assert(err, IsNil)
+	c.Check(defs, DeepEquals, []*IndexDef{})
+
+	_, err = this.table.Put(&Record{Id: "b", Rev: revB, Doc: email("b@x")})
+	c.Assert(err, IsNil)
+	c.Assert(this.table.DefineIndex(unique), IsNil)
+
+	_, err = this.table.Put(&Record{Id: "c", Doc: email("a@x")})
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+	revC, err := this.table.Put(&Record{Id: "c", Doc: email("c@x")})
+	c.Assert(err, IsNil)
+	c.Check(this.lookup("email", "a@x"), DeepEquals, []string{"a"})
+
+	// deleting a record frees its keys
+	_, err = this.table.Delete("c", revC)
+	c.Assert(err, IsNil)
+	_, err = this.table.Put(&Record{Id: "d", Doc: email("c@x")})
+	c.Assert(err, IsNil)
+
+	// records written together can't share a key either
+	results, err := this.table.PutMany([]*Record{
+		{Id: "e", Doc: email("e@x")},
+		{Id: "f", Doc: email("e@x")},
+	}, false)
+	c.Assert(err, IsNil)
+	c.Check(results[0].Error, IsNil)
+	c.Assert(results[1].Error, NotNil)
+	c.Check(results[1].Error.Code, Equals, EConflict)
+	_, err = this.table.PutMany([]*Record{
+		{Id: "g", Doc: email("g@x")},
+		{Id: "h", Doc: email("g@x")},
+	}, true)
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+	c.Check(this.lookup("email", "g@x"), DeepEquals, []string{})
+
+	// a transaction fails when it writes the key, or else when it commits
+	tx, err := this.db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Put("table", &Record{Id: "i", Doc: email("b@x")})
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		c.Assert(tx.Rollback(), IsNil)
+	}
+	c.Assert(err, NotNil)
+	c.Check(err.Code, Equals, EConflict)
+	this.expectIds(&Query{Index: "email", Limit: 10}, "a", "b", "d", "e")
+}
+
+func (this *TestSuite) expectIds(query *Query, ids ...string) {
+	ch, err := this.table.Get(context.Background(), query)
+	this.c.Assert(err, IsNil)
+	this.c.Check(this.ids(ch), DeepEquals, ids)
+}
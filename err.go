@@ -18,6 +18,12 @@ const (
 	EBadRequest
 	ENotFound
 	EMultiple
+	EBadTx
+	EUnauthorized
+	EForbidden
+	EInvalid
+	EPrecondition
+	ESerialTx
 )
 
 var (
@@ -36,6 +42,12 @@ var (
 		EBadRequest:    "Invalid request",
 		ENotFound:      "Record not found",
 		EMultiple:      "Multiple records found",
+		EBadTx:         "Transaction not found or already finished",
+		EUnauthorized:  "Authentication required",
+		EForbidden:     "Access denied to database: '{{.name}}'",
+		EInvalid:       "Document does not match the schema: {{range $i, $e := .errors}}{{if $i}}; {{end}}{{$e}}{{end}}",
+		EPrecondition:  "Precondition failed: {{.name}}",
+		ESerialTx:      "Transactions are not supported by database: '{{.name}}'",
 	}
 )
 
@@ -69,3 +81,7 @@ func IsConflict(err error) bool {
 func IsBadTable(err error) bool {
 	return IsError(err, EBadTable)
 }
+
+func IsInvalid(err error) bool {
+	return IsError(err, EInvalid)
+}
@@ -1,16 +1,34 @@
 package kissdif
 
 import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/flaub/ergo"
+	"io"
+	"strconv"
+	"strings"
 )
 
 type Dictionary map[string]string
 
 type ResultSet struct {
 	More    bool
+	Cursor  string `json:",omitempty"`
 	Records []*Record
 }
 
+// Chunk is one frame of a streamed query result. Each frame carries a
+// record except the last, which says whether more records match the query.
+type Chunk struct {
+	_struct bool        `codec:",omitempty"` // set omitempty for every field
+	Record  *Record     `json:",omitempty"`
+	More    bool        `json:",omitempty"`
+	Cursor  string      `json:",omitempty"`
+	Error   *ergo.Error `json:",omitempty"` // why the result ended early
+}
+
 type DatabaseCfg struct {
 	_struct bool              `codec:",omitempty"` // set omitempty for every field
 	Name    string            `json:",omitempty"`
@@ -28,10 +46,13 @@ func (this Bound) IsDefined() bool {
 }
 
 type Query struct {
-	Index string
-	Lower Bound
-	Upper Bound
-	Limit uint
+	Index      string
+	Lower      Bound
+	Upper      Bound
+	Limit      uint
+	After      string
+	Descending bool
+	Deleted    bool // include tombstones
 }
 
 type IndexMap map[string][]string
@@ -42,6 +63,40 @@ type Record struct {
 	Rev     string      `json:",omitempty"`
 	Doc     interface{} `json:",omitempty"`
 	Keys    IndexMap    `json:",omitempty"`
+	Deleted bool        `json:",omitempty"`  // set on the tombstone left by a delete
+	Cursor  string      `json:"-" codec:"-"` // position of this record within a query
+}
+
+// Change describes the latest update to a record in a table's changes feed.
+type Change struct {
+	_struct bool   `codec:",omitempty"` // set omitempty for every field
+	Seq     uint64 `json:",omitempty"`
+	Id      string `json:",omitempty"`
+	Rev     string `json:",omitempty"`
+	Deleted bool   `json:",omitempty"`
+}
+
+type ChangeSet struct {
+	LastSeq uint64
+	Changes []*Change
+}
+
+// Bulk is a batch of writes to a single table. Records with Deleted set are
+// deleted at their Rev, the others are put. Unless Partial is set, either
+// every write succeeds or none is made.
+type Bulk struct {
+	_struct bool      `codec:",omitempty"` // set omitempty for every field
+	Records []*Record `json:",omitempty"`
+	Partial bool      `json:",omitempty"`
+}
+
+// BulkResult is the outcome of one write in a Bulk. Rev is the new revision,
+// or "" for a delete that found nothing to delete.
+type BulkResult struct {
+	_struct bool        `codec:",omitempty"` // set omitempty for every field
+	Id      string      `json:",omitempty"`
+	Rev     string      `json:",omitempty"`
+	Error   *ergo.Error `json:",omitempty"`
 }
 
 func NewRecord(id, rev string, doc interface{}) *Record {
@@ -88,13 +143,171 @@ func (this IndexMap) Clone() IndexMap {
 	return keys
 }
 
+// IndexDef defines an index whose keys the drivers compute from each
+// document, in place of any keys put with it. Path is a JSON pointer into
+// the document: the string, number or boolean found there is the key, or
+// each of them within an array found there. Numbers are keyed by their
+// shortest form, so 2, 2.0 and 20e-1 share the key "2". Documents without
+// such a value, or where it is "", are left out of the index. No two
+// records may share a key of a Unique index. Names starting with "_" are
+// reserved.
+type IndexDef struct {
+	_struct bool   `codec:",omitempty"` // set omitempty for every field
+	Name    string `json:",omitempty"`
+	Path    string `json:",omitempty"`
+	Unique  bool   `json:",omitempty"`
+}
+
+// Validate checks that the index can be defined.
+func (this *IndexDef) Validate() *ergo.Error {
+	if this.Name == "" || strings.HasPrefix(this.Name, "_") {
+		return NewError(EBadParam, "name", "index", "value", this.Name)
+	}
+	if this.Path != "" && !strings.HasPrefix(this.Path, "/") {
+		return NewError(EBadParam, "name", "path", "value", this.Path)
+	}
+	return nil
+}
+
+// Keys returns the index keys of a document, as decoded from JSON with
+// numbers kept as json.Number.
+func (this *IndexDef) Keys(doc interface{}) []string {
+	value := doc
+	if this.Path != "" {
+		for _, token := range strings.Split(this.Path[1:], "/") {
+			token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+			switch node := value.(type) {
+			case map[string]interface{}:
+				value = node[token]
+			case []interface{}:
+				i, err := strconv.Atoi(token)
+				if err != nil || i < 0 || i >= len(node) {
+					return nil
+				}
+				value = node[i]
+			default:
+				return nil
+			}
+		}
+	}
+	if list, ok := value.([]interface{}); ok {
+		keys := make(IndexMap)
+		for _, item := range list {
+			if key, ok := indexKey(item); ok {
+				keys.Add(this.Name, key)
+			}
+		}
+		return keys[this.Name]
+	}
+	if key, ok := indexKey(value); ok {
+		return []string{key}
+	}
+	return nil
+}
+
+func indexKey(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, value != ""
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return value.String(), true
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
 func NewQuery(index string, lower, upper Bound, limit uint) *Query {
-	return &Query{index, lower, upper, limit}
+	return &Query{Index: index, Lower: lower, Upper: upper, Limit: limit}
 }
 
 func NewQueryEQ(index, key string, limit uint) *Query {
 	bound := Bound{true, key}
-	return &Query{index, bound, bound, limit}
+	return &Query{Index: index, Lower: bound, Upper: bound, Limit: limit}
+}
+
+// NewCursor returns an opaque continuation token that positions a query
+// just past the entry with the given index value and record id.
+func NewCursor(value, id string) string {
+	raw, _ := json.Marshal([]string{value, id})
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+// ParseCursor returns the index value and record id encoded in a token
+// produced by NewCursor.
+func ParseCursor(cursor string) (value, id string, err *ergo.Error) {
+	raw, rerr := base64.URLEncoding.DecodeString(cursor)
+	if rerr != nil {
+		return "", "", NewError(EBadParam, "name", "cursor", "value", cursor)
+	}
+	var parts []string
+	rerr = json.Unmarshal(raw, &parts)
+	if rerr != nil || len(parts) != 2 {
+		return "", "", NewError(EBadParam, "name", "cursor", "value", cursor)
+	}
+	return parts[0], parts[1], nil
+}
+
+// NewRevision returns the revision that follows prev for a record whose
+// encoded document is doc. Revisions have the form "N-hash", where N is a
+// generation counter starting at 1 and hash covers both prev and doc, so
+// writing the same document twice still yields a new revision.
+func NewRevision(prev, doc string) string {
+	gen, _, err := ParseRevision(prev)
+	if err != nil {
+		gen = 0
+	}
+	hasher := sha1.New()
+	io.WriteString(hasher, prev)
+	io.WriteString(hasher, doc)
+	return fmt.Sprintf("%d-%x", gen+1, hasher.Sum(nil))
+}
+
+// ParseRevision returns the generation and hash of a revision produced by
+// NewRevision.
+func ParseRevision(rev string) (gen uint64, hash string, err *ergo.Error) {
+	parts := strings.SplitN(rev, "-", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", NewError(EBadParam, "name", "rev", "value", rev)
+	}
+	gen, perr := strconv.ParseUint(parts[0], 10, 64)
+	if perr != nil || gen == 0 {
+		return 0, "", NewError(EBadParam, "name", "rev", "value", rev)
+	}
+	return gen, parts[1], nil
+}
+
+// CompareRevisions returns -1, 0 or 1 depending on whether a is older than,
+// the same as, or newer than b. Revisions are ordered by generation, with
+// the hash breaking ties. Malformed revisions are older than any other.
+func CompareRevisions(a, b string) int {
+	genA, hashA, errA := ParseRevision(a)
+	genB, hashB, errB := ParseRevision(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	case genA < genB:
+		return -1
+	case genA > genB:
+		return 1
+	}
+	return strings.Compare(hashA, hashB)
+}
+
+// Err returns the error that failed the write, if any.
+func (this *BulkResult) Err() error {
+	if this.Error == nil {
+		return nil
+	}
+	return this.Error
 }
 
 func (this *ResultSet) String() string {
@@ -1,14 +1,79 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	_ "github.com/flaub/kissdif/driver/mem"
 	_ "github.com/flaub/kissdif/driver/sql"
 	"github.com/flaub/kissdif/server"
+	"io"
+	"os"
+	"strings"
 )
 
 func main() {
+	configPath := flag.String("config", "", "JSON file to read settings from")
+	addr := flag.String("addr", "", "address to listen on (default \":7780\")")
+	cert := flag.String("cert", "", "TLS certificate file")
+	key := flag.String("key", "", "TLS key file")
+	dataDir := flag.String("data", "", "directory to record databases in")
+	credentials := flag.String("credentials", "", "JSON file of the users allowed in")
+	tokenKey := flag.String("token-key", "", "file holding the key to sign bearer tokens with")
+	hashPassword := flag.Bool("hash-password", false, "print a credential file entry for the password read from stdin")
+	flag.Parse()
+
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		user, kerr := server.NewUser(strings.TrimRight(password, "\r\n"))
+		if kerr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", kerr)
+			os.Exit(1)
+		}
+		json.NewEncoder(os.Stdout).Encode(user)
+		return
+	}
+
+	config := server.NewConfig()
+	if *configPath != "" {
+		kerr := config.Load(*configPath)
+		if kerr != nil {
+			fmt.Fprintf(os.Stderr, "Reading %s failed: %v\n", *configPath, kerr)
+			os.Exit(1)
+		}
+	}
+	// flags given on the command line take precedence over the file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			config.Addr = *addr
+		case "cert":
+			config.CertFile = *cert
+		case "key":
+			config.KeyFile = *key
+		case "data":
+			config.DataDir = *dataDir
+		case "credentials":
+			config.Credentials = *credentials
+		case "token-key":
+			config.TokenKeyFile = *tokenKey
+		}
+	})
+
 	fmt.Println("KISS Data Interface")
-	srv := server.NewServer()
-	srv.ListenAndServe()
+	srv, kerr := server.Open(config)
+	if kerr != nil {
+		fmt.Fprintf(os.Stderr, "Opening databases failed: %v\n", kerr)
+		os.Exit(1)
+	}
+	err := srv.ListenAndServe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 }
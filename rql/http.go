@@ -2,6 +2,7 @@ package rql
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/flaub/ergo"
@@ -11,13 +12,24 @@ import (
 	_ "log"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var (
-	MsgpackHandle = &codec.MsgpackHandle{}
+	MsgpackHandle = newMsgpackHandle()
 )
 
+func newMsgpackHandle() *codec.MsgpackHandle {
+	handle := &codec.MsgpackHandle{}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	handle.RawToString = true
+	handle.Raw = true // documents are passed on as they were received
+	return handle
+}
+
 type Decoder interface {
 	Decode(v interface{}) error
 }
@@ -29,15 +41,38 @@ type Encoder interface {
 type MakeDecoder func(io.Reader) Decoder
 type MakeEncoder func(io.Writer) Encoder
 
+const maxCacheEntries = 1000
+
 type httpConn struct {
 	baseUrl   string
 	formatter formatter
+	cache     map[string]*cacheEntry
+	mutex     sync.Mutex
+	tx        string // transaction that document requests are made in
+	user      *url.Userinfo
+	token     string // sent as a bearer token instead of user
+}
+
+// cacheEntry remembers the last result of a single record lookup along
+// with its ETag so that the lookup can be revalidated with If-None-Match.
+type cacheEntry struct {
+	etag   string
+	result *ResultSetImpl
 }
 
 type formatter interface {
 	ContentType() string
 	Encoder(io.Writer) Encoder
 	Decoder(io.Reader) Decoder
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// formatters are the formats a connection can use, by the name given to
+// the format parameter of its URL.
+var formatters = map[string]formatter{
+	"json":    &jsonFormatter{},
+	"msgpack": &msgpackFormatter{},
 }
 
 type msgpackFormatter struct{}
@@ -54,6 +89,16 @@ func (this *msgpackFormatter) Decoder(r io.Reader) Decoder {
 	return codec.NewDecoder(r, MsgpackHandle)
 }
 
+func (this *msgpackFormatter) Marshal(v interface{}) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, MsgpackHandle).Encode(v)
+	return data, err
+}
+
+func (this *msgpackFormatter) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, MsgpackHandle).Decode(v)
+}
+
 type jsonFormatter struct{}
 
 func (this *jsonFormatter) ContentType() string {
@@ -69,11 +114,19 @@ func (this *jsonFormatter) Decoder(r io.Reader) Decoder {
 	return json.NewDecoder(r)
 }
 
-func newHttpConn(url string) *httpConn {
+func (this *jsonFormatter) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (this *jsonFormatter) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func newHttpConn(url string, formatter formatter) *httpConn {
 	return &httpConn{
-		baseUrl: url,
-		// formatter: &msgpackFormatter{},
-		formatter: &jsonFormatter{},
+		baseUrl:   url,
+		formatter: formatter,
+		cache:     make(map[string]*cacheEntry),
 	}
 }
 
@@ -85,7 +138,7 @@ func (this *httpConn) makeUrl(impl QueryImpl) string {
 		url.QueryEscape(impl.Query_.Index))
 }
 
-func (this *httpConn) sendRequest(method, url string, v interface{}) (*http.Response, error) {
+func (this *httpConn) newRequest(method, url string, v interface{}) (*http.Request, error) {
 	var buf bytes.Buffer
 	err := this.formatter.Encoder(&buf).Encode(v)
 	if err != nil {
@@ -96,6 +149,16 @@ func (this *httpConn) sendRequest(method, url string, v interface{}) (*http.Resp
 		return nil, ergo.Wrap(err)
 	}
 	req.Header.Set("Content-Type", this.formatter.ContentType())
+	if this.token != "" {
+		req.Header.Set("Authorization", "Bearer "+this.token)
+	} else if this.user != nil {
+		password, _ := this.user.Password()
+		req.SetBasicAuth(this.user.Username(), password)
+	}
+	return req, nil
+}
+
+func (this *httpConn) send(req *http.Request) (*http.Response, error) {
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, ergo.Wrap(err)
@@ -103,6 +166,14 @@ func (this *httpConn) sendRequest(method, url string, v interface{}) (*http.Resp
 	return resp, nil
 }
 
+func (this *httpConn) sendRequest(method, url string, v interface{}) (*http.Response, error) {
+	req, err := this.newRequest(method, url, v)
+	if err != nil {
+		return nil, err
+	}
+	return this.send(req)
+}
+
 func (this *httpConn) recvReply(resp *http.Response, v interface{}) error {
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -151,18 +222,93 @@ func (this *httpConn) CreateDB(name, driverName string, config kissdif.Dictionar
 }
 
 func (this *httpConn) DropDB(name string) error {
-	return ergo.Wrap("Not implemented")
+	url := fmt.Sprintf("%s/%s", this.baseUrl, url.QueryEscape(name))
+	return this.roundTrip("DELETE", url, nil, nil)
+}
+
+func (this *httpConn) DropTable(impl QueryImpl) error {
+	url := fmt.Sprintf("%s/%s/%s",
+		this.baseUrl,
+		url.QueryEscape(impl.Db_),
+		url.QueryEscape(impl.Table_))
+	return this.roundTrip("DELETE", url, nil, nil)
+}
+
+func (this *httpConn) ListDBs() ([]kissdif.DatabaseCfg, error) {
+	var result []kissdif.DatabaseCfg
+	err := this.roundTrip("GET", this.baseUrl+"/", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *httpConn) ListTables(db string) ([]string, error) {
+	url := fmt.Sprintf("%s/%s", this.baseUrl, url.QueryEscape(db))
+	var result []string
+	err := this.roundTrip("GET", url, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *httpConn) ListIndexes(db, table string) ([]string, error) {
+	url := fmt.Sprintf("%s/%s/%s",
+		this.baseUrl,
+		url.QueryEscape(db),
+		url.QueryEscape(table))
+	var result []string
+	err := this.roundTrip("GET", url, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *httpConn) DefineIndex(db, table string, def *kissdif.IndexDef) error {
+	url := fmt.Sprintf("%s/%s/%s/_index/%s",
+		this.baseUrl,
+		url.QueryEscape(db),
+		url.QueryEscape(table),
+		url.QueryEscape(def.Name))
+	return this.roundTrip("PUT", url, def, nil)
+}
+
+func (this *httpConn) ListIndexDefs(db, table string) ([]*kissdif.IndexDef, error) {
+	url := fmt.Sprintf("%s/%s/%s/_index",
+		this.baseUrl,
+		url.QueryEscape(db),
+		url.QueryEscape(table))
+	var result []*kissdif.IndexDef
+	err := this.roundTrip("GET", url, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (this *httpConn) RegisterType(name string, doc interface{}) {
 }
 
-func (this *httpConn) Get(impl QueryImpl) (ResultSet, error) {
+func (this *httpConn) Get(ctx context.Context, impl QueryImpl) (ResultSet, error) {
 	args := make(url.Values)
 	query := impl.Query_
 	if query.Limit != 0 {
 		args.Set("limit", strconv.Itoa(int(query.Limit)))
 	}
+	if query.After != "" {
+		args.Set("cursor", query.After)
+	}
+	if query.Descending {
+		args.Set("desc", "1")
+	}
+	if query.Deleted {
+		args.Set("deleted", "1")
+	}
+	if this.tx != "" {
+		args.Set("tx", this.tx)
+	}
 	if query.Lower.IsDefined() && query.Upper.IsDefined() &&
 		query.Lower.Value == query.Upper.Value {
 		args.Set("eq", query.Lower.Value)
@@ -182,30 +328,270 @@ func (this *httpConn) Get(impl QueryImpl) (ResultSet, error) {
 			}
 		}
 	}
+	// only single record lookups are cached; anything else is streamed
+	if args.Get("eq") != "" && query.After == "" && query.Limit == 1 {
+		args.Del("eq")
+		url := this.makeUrl(impl) + "/" + url.QueryEscape(query.Lower.Value) + "?" + args.Encode()
+		return this.getRecord(ctx, url)
+	}
+	args.Set("stream", "1")
 	url := this.makeUrl(impl) + "?" + args.Encode()
+	req, err := this.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := this.send(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, this.recvReply(resp, nil)
+	}
+	src := &httpSource{
+		body:   resp.Body,
+		dec:    this.formatter.Decoder(resp.Body),
+		format: this.formatter,
+	}
+	return newStreamResultSet(src), nil
+}
+
+// chunkImpl is the form of kissdif.Chunk decoded by the HTTP connection.
+type chunkImpl struct {
+	Record_ *RecordImpl `json:"record,omitempty" codec:"Record,omitempty"`
+	More_   bool        `json:"more,omitempty" codec:"More,omitempty"`
+	Cursor_ string      `json:"cursor,omitempty" codec:"Cursor,omitempty"`
+	Error_  *ergo.Error `json:"error,omitempty" codec:"Error,omitempty"`
+}
+
+// httpSource is a recordSource decoding the chunks of a streamed query
+// as they arrive.
+type httpSource struct {
+	body   io.ReadCloser
+	dec    Decoder
+	format formatter
+}
+
+func (this *httpSource) next() (*RecordImpl, bool, string, error) {
+	var chunk chunkImpl
+	err := this.dec.Decode(&chunk)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, false, "", ergo.Wrap(err)
+	}
+	if chunk.Error_ != nil {
+		return nil, false, "", chunk.Error_
+	}
+	if chunk.Record_ != nil {
+		chunk.Record_.format = this.format
+	}
+	return chunk.Record_, chunk.More_, chunk.Cursor_, nil
+}
+
+func (this *httpSource) close() {
+	this.body.Close()
+}
+
+// getRecord performs a single key lookup, revalidating any cached result
+// with If-None-Match.
+func (this *httpConn) getRecord(ctx context.Context, url string) (ResultSet, error) {
+	req, err := this.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	this.mutex.Lock()
+	entry := this.cache[url]
+	this.mutex.Unlock()
+	if entry != nil {
+		req.Header.Set("If-None-Match", strconv.Quote(entry.etag))
+	}
+	resp, err := this.send(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		return entry.result.clone(), nil
+	}
 	var result ResultSetImpl
-	kerr := this.roundTrip("GET", url, nil, &result)
-	if kerr != nil {
-		return nil, kerr
+	err = this.recvReply(resp, &result)
+	if kissdif.IsError(err, kissdif.ENotFound) {
+		this.uncache(url)
+		return &ResultSetImpl{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range result.Records_ {
+		record.format = this.formatter
+	}
+	// the ETag only covers the records returned, so a result with more to
+	// follow can't be revalidated by it
+	etag, err := strconv.Unquote(resp.Header.Get("ETag"))
+	if err != nil || result.More_ {
+		this.uncache(url)
+	} else {
+		this.mutex.Lock()
+		if len(this.cache) >= maxCacheEntries {
+			this.cache = make(map[string]*cacheEntry)
+		}
+		this.cache[url] = &cacheEntry{etag: etag, result: result.clone()}
+		this.mutex.Unlock()
 	}
 	return &result, nil
 }
 
+func (this *httpConn) uncache(url string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.cache, url)
+}
+
 func (this *httpConn) Put(impl QueryImpl) (string, error) {
 	record := impl.Record_
 	if record.Id == "" {
 		return "", kissdif.NewError(kissdif.EBadParam, "name", "id", "value", record.Id)
 	}
-	url := this.makeUrl(impl) + "/" + url.QueryEscape(record.Id)
+	url := this.makeUrl(impl) + "/" + url.QueryEscape(record.Id) + this.txQuery()
+	req, err := this.newRequest("PUT", url, record)
+	if err != nil {
+		return "", err
+	}
+	if record.Rev != "" {
+		req.Header.Set("If-Match", strconv.Quote(record.Rev))
+	}
+	resp, err := this.send(req)
+	if err != nil {
+		return "", err
+	}
 	var rev string
-	kerr := this.roundTrip("PUT", url, record, &rev)
-	if kerr != nil {
-		return "", kerr
+	err = this.recvReply(resp, &rev)
+	if err != nil {
+		return "", err
+	}
+	etag, err := strconv.Unquote(resp.Header.Get("ETag"))
+	if err == nil {
+		rev = etag
 	}
 	return rev, nil
 }
 
+func (this *httpConn) PutMany(impl QueryImpl, bulk *kissdif.Bulk) ([]*kissdif.BulkResult, error) {
+	url := fmt.Sprintf("%s/%s/%s/_bulk",
+		this.baseUrl,
+		url.QueryEscape(impl.Db_),
+		url.QueryEscape(impl.Table_))
+	var results []*kissdif.BulkResult
+	err := this.roundTrip("POST", url, bulk, &results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (this *httpConn) Changes(ctx context.Context, impl QueryImpl, since uint64, wait time.Duration) (*kissdif.ChangeSet, error) {
+	url := fmt.Sprintf("%s/%s/%s/_changes?since=%d",
+		this.baseUrl,
+		url.QueryEscape(impl.Db_),
+		url.QueryEscape(impl.Table_),
+		since)
+	if wait > 0 {
+		url += fmt.Sprintf("&feed=longpoll&timeout=%d", wait/time.Millisecond)
+	}
+	req, err := this.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := this.send(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var result kissdif.ChangeSet
+	err = this.recvReply(resp, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 func (this *httpConn) Delete(impl QueryImpl) error {
-	url := this.makeUrl(impl) + "/" + url.QueryEscape(impl.Record_.Id)
-	return this.roundTrip("DELETE", url, nil, nil)
+	_, err := this.delete(impl)
+	return err
+}
+
+// delete returns the revision of the tombstone left behind, if any.
+func (this *httpConn) delete(impl QueryImpl) (string, error) {
+	url := this.makeUrl(impl) + "/" + url.QueryEscape(impl.Record_.Id) + this.txQuery()
+	req, err := this.newRequest("DELETE", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if impl.Record_.Rev != "" {
+		req.Header.Set("If-Match", strconv.Quote(impl.Record_.Rev))
+	}
+	resp, err := this.send(req)
+	if err != nil {
+		return "", err
+	}
+	err = this.recvReply(resp, nil)
+	if err != nil {
+		return "", err
+	}
+	rev, err := strconv.Unquote(resp.Header.Get("ETag"))
+	if err != nil {
+		return "", nil
+	}
+	return rev, nil
+}
+
+// txQuery returns the query string that makes a document request part of
+// the connection's transaction, if any.
+func (this *httpConn) txQuery() string {
+	if this.tx == "" {
+		return ""
+	}
+	return "?tx=" + url.QueryEscape(this.tx)
+}
+
+func (this *httpConn) Tx(fn func(tx Conn) error) error {
+	return runTx(this, this.begin, fn)
+}
+
+func (this *httpConn) begin(db string) (txn, error) {
+	var id string
+	err := this.roundTrip("POST", this.txUrl(db, ""), nil, &id)
+	if err != nil {
+		return nil, err
+	}
+	conn := newHttpConn(this.baseUrl, this.formatter)
+	conn.user = this.user
+	conn.token = this.token
+	conn.tx = id
+	return &httpTxn{httpConn: conn, db: db}, nil
+}
+
+func (this *httpConn) txUrl(db, id string) string {
+	url := fmt.Sprintf("%s/%s/_tx", this.baseUrl, url.QueryEscape(db))
+	if id != "" {
+		url += "/" + id
+	}
+	return url
+}
+
+type httpTxn struct {
+	*httpConn
+	db string
+}
+
+func (this *httpTxn) Delete(impl QueryImpl) (string, error) {
+	return this.delete(impl)
+}
+
+func (this *httpTxn) Commit() error {
+	return this.roundTrip("POST", this.txUrl(this.db, this.tx), nil, nil)
+}
+
+func (this *httpTxn) Rollback() error {
+	return this.roundTrip("DELETE", this.txUrl(this.db, this.tx), nil, nil)
 }
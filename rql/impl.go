@@ -1,14 +1,16 @@
 package rql
 
 import (
-	"encoding/json"
+	"context"
 	"github.com/flaub/ergo"
 	"github.com/flaub/kissdif"
+	"github.com/ugorji/go/codec"
 )
 
 type ResultSetImpl struct {
-	More_    bool          `json:"more,omitempty" codec:"more,omitempty"`
-	Records_ []*RecordImpl `json:"records,omitempty" codec:"records,omitempty"`
+	More_    bool          `json:"more,omitempty" codec:"More,omitempty"`
+	Cursor_  string        `json:"cursor,omitempty" codec:"Cursor,omitempty"`
+	Records_ []*RecordImpl `json:"records,omitempty" codec:"Records,omitempty"`
 }
 
 type RecordReaderImpl struct {
@@ -21,6 +23,10 @@ func (this *ResultSetImpl) More() bool {
 	return this.More_
 }
 
+func (this *ResultSetImpl) Cursor() string {
+	return this.Cursor_
+}
+
 func (this *ResultSetImpl) Count() int {
 	return len(this.Records_)
 }
@@ -29,6 +35,14 @@ func (this *ResultSetImpl) Reader() RecordReader {
 	return &RecordReaderImpl{records: this.Records_}
 }
 
+func (this *ResultSetImpl) clone() *ResultSetImpl {
+	result := &ResultSetImpl{More_: this.More_, Cursor_: this.Cursor_}
+	for _, record := range this.Records_ {
+		result.Records_ = append(result.Records_, record.clone())
+	}
+	return result
+}
+
 func (this *RecordReaderImpl) Record() Record {
 	return this.record
 }
@@ -50,11 +64,142 @@ func (this *RecordReaderImpl) MustScan(into interface{}) interface{} {
 	return this.Record().MustScan(into)
 }
 
+func (this *RecordReaderImpl) Err() error {
+	return nil
+}
+
+func (this *RecordReaderImpl) Close() error {
+	return nil
+}
+
+// recordSource yields the records of a query result in order. After the
+// last one it returns a nil record, along with whether more records match
+// the query and the cursor to continue from.
+type recordSource interface {
+	next() (record *RecordImpl, more bool, cursor string, err error)
+	close()
+}
+
+// streamResultSet reads records from its source as its reader asks for
+// them. More, Cursor and Count are only known at the end of the result, so
+// calling them reads the remaining records ahead.
+type streamResultSet struct {
+	src    recordSource
+	ahead  []*RecordImpl
+	record *RecordImpl
+	count  int
+	more   bool
+	cursor string
+	done   bool
+	err    error
+}
+
+func newStreamResultSet(src recordSource) *streamResultSet {
+	return &streamResultSet{src: src}
+}
+
+// read returns the next record from the source, or nil at the end.
+func (this *streamResultSet) read() *RecordImpl {
+	if this.done {
+		return nil
+	}
+	record, more, cursor, err := this.src.next()
+	if err != nil || record == nil {
+		this.more, this.cursor, this.err = more, cursor, err
+		this.Close()
+		return nil
+	}
+	this.count++
+	return record
+}
+
+func (this *streamResultSet) drain() {
+	for record := this.read(); record != nil; record = this.read() {
+		this.ahead = append(this.ahead, record)
+	}
+}
+
+func (this *streamResultSet) More() bool {
+	this.drain()
+	return this.more
+}
+
+func (this *streamResultSet) Cursor() string {
+	this.drain()
+	return this.cursor
+}
+
+func (this *streamResultSet) Count() int {
+	this.drain()
+	return this.count
+}
+
+func (this *streamResultSet) Reader() RecordReader {
+	return this
+}
+
+func (this *streamResultSet) Next() bool {
+	if len(this.ahead) != 0 {
+		this.record = this.ahead[0]
+		this.ahead = this.ahead[1:]
+		return true
+	}
+	this.record = this.read()
+	return this.record != nil
+}
+
+func (this *streamResultSet) Record() Record {
+	return this.record
+}
+
+func (this *streamResultSet) Scan(into interface{}) (interface{}, error) {
+	return this.Record().Scan(into)
+}
+
+func (this *streamResultSet) MustScan(into interface{}) interface{} {
+	return this.Record().MustScan(into)
+}
+
+func (this *streamResultSet) Err() error {
+	return this.err
+}
+
+func (this *streamResultSet) Close() error {
+	if !this.done {
+		this.done = true
+		this.src.close()
+	}
+	return nil
+}
+
 type RecordImpl struct {
-	Id_   string           `json:"id,omitempty" codec:"id,omitempty"`
-	Rev_  string           `json:"rev,omitempty" codec:"rev,omitempty"`
-	Doc_  json.RawMessage  `json:"doc,omitempty" codec:"doc,omitempty"`
-	Keys_ kissdif.IndexMap `json:"keys,omitempty" codec:"keys,omitempty"`
+	Id_      string           `json:"id,omitempty" codec:"Id,omitempty"`
+	Rev_     string           `json:"rev,omitempty" codec:"Rev,omitempty"`
+	Doc_     rawDoc           `json:"doc,omitempty" codec:"Doc,omitempty"`
+	Keys_    kissdif.IndexMap `json:"keys,omitempty" codec:"Keys,omitempty"`
+	Deleted_ bool             `json:"deleted,omitempty" codec:"Deleted,omitempty"`
+
+	cursor string
+	format formatter // format of Doc_, JSON if unset
+}
+
+// rawDoc is a document as it was encoded on the wire, kept as is until it
+// is scanned.
+type rawDoc []byte
+
+func (this *rawDoc) UnmarshalJSON(data []byte) error {
+	*this = append(rawDoc(nil), data...)
+	return nil
+}
+
+func (this *rawDoc) CodecEncodeSelf(enc *codec.Encoder) {
+	enc.MustEncode(codec.Raw(*this))
+}
+
+func (this *rawDoc) CodecDecodeSelf(dec *codec.Decoder) {
+	var raw codec.Raw
+	dec.MustDecode(&raw)
+	*this = append(rawDoc(nil), raw...)
 }
 
 func (this *RecordImpl) Id() string {
@@ -65,8 +210,36 @@ func (this *RecordImpl) Rev() string {
 	return this.Rev_
 }
 
+func (this *RecordImpl) Deleted() bool {
+	return this.Deleted_
+}
+
+func (this *RecordImpl) clone() *RecordImpl {
+	result := &RecordImpl{
+		Id_:      this.Id_,
+		Rev_:     this.Rev_,
+		Doc_:     append(rawDoc(nil), this.Doc_...),
+		Deleted_: this.Deleted_,
+		format:   this.format,
+	}
+	if this.Keys_ != nil {
+		result.Keys_ = make(kissdif.IndexMap)
+		for name, keys := range this.Keys_ {
+			result.Keys_[name] = append([]string(nil), keys...)
+		}
+	}
+	return result
+}
+
+func (this *RecordImpl) formatter() formatter {
+	if this.format == nil {
+		return formatters["json"]
+	}
+	return this.format
+}
+
 func (this *RecordImpl) Scan(into interface{}) (interface{}, error) {
-	err := json.Unmarshal(this.Doc_, into)
+	err := this.formatter().Unmarshal(this.Doc_, into)
 	return into, err
 }
 
@@ -79,7 +252,7 @@ func (this *RecordImpl) MustScan(into interface{}) interface{} {
 }
 
 func (this *RecordImpl) Set(doc interface{}) (err error) {
-	this.Doc_, err = json.Marshal(doc)
+	this.Doc_, err = this.formatter().Marshal(doc)
 	return err
 }
 
@@ -106,6 +279,25 @@ type deleteStmt struct {
 	QueryImpl
 }
 
+type dropTableStmt struct {
+	QueryImpl
+}
+
+type changesStmt struct {
+	QueryImpl
+	since uint64
+}
+
+type batchStmt struct {
+	items   []BatchItem
+	partial bool
+}
+
+type subscribeStmt struct {
+	QueryImpl
+	since uint64
+}
+
 type QueryImpl struct {
 	Db_     string
 	Table_  string
@@ -128,7 +320,7 @@ func newQuery(db string) QueryImpl {
 
 func (this QueryImpl) DropTable(name string) ExecStmt {
 	this.Table_ = name
-	return nil
+	return dropTableStmt{this}
 }
 
 func (this QueryImpl) Table(name string) Table {
@@ -141,6 +333,21 @@ func (this QueryImpl) Limit(count uint) Query {
 	return this
 }
 
+func (this QueryImpl) After(cursor string) Limitable {
+	this.Query_.After = cursor
+	return this
+}
+
+func (this QueryImpl) Reverse() Limitable {
+	this.Query_.Descending = true
+	return this
+}
+
+func (this QueryImpl) WithDeleted() Query {
+	this.Query_.Deleted = true
+	return this
+}
+
 func (this QueryImpl) By(index string) Query {
 	this.Query_.Index = index
 	return this
@@ -180,7 +387,7 @@ func (this QueryImpl) Update(id, rev string, doc interface{}) PutStmt {
 	return putStmt{this}
 }
 
-func (this QueryImpl) Delete(id, rev string) ExecStmt {
+func (this QueryImpl) Delete(id, rev string) DeleteStmt {
 	this.Record_.Id = id
 	this.Record_.Rev = rev
 	return deleteStmt{this}
@@ -194,12 +401,20 @@ func (this QueryImpl) UpdateRecord(record Record) PutStmt {
 	return stmt.Keys(record.Keys())
 }
 
-func (this QueryImpl) DeleteRecord(record Record) ExecStmt {
+func (this QueryImpl) DeleteRecord(record Record) DeleteStmt {
 	this.Record_.Id = record.Id()
 	this.Record_.Rev = record.Rev()
 	return deleteStmt{this}
 }
 
+func (this QueryImpl) Changes(since uint64) ChangesStmt {
+	return changesStmt{this, since}
+}
+
+func (this QueryImpl) Subscribe(since uint64) SubscribeStmt {
+	return subscribeStmt{this, since}
+}
+
 func (this putStmt) Exec(conn Conn) (string, error) {
 	result, err := conn.Put(this.QueryImpl)
 	return result, ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
@@ -216,30 +431,109 @@ func (this putStmt) By(key, value string) PutStmt {
 	return this
 }
 
+func (this putStmt) batchItem() (QueryImpl, kissdif.Record) {
+	record := this.Record_
+	record.Keys = record.Keys.Clone()
+	return this.QueryImpl, record
+}
+
+func (this deleteStmt) batchItem() (QueryImpl, kissdif.Record) {
+	return this.QueryImpl, kissdif.Record{
+		Id:      this.Record_.Id,
+		Rev:     this.Record_.Rev,
+		Deleted: true,
+	}
+}
+
+func (this batchStmt) Partial() BatchStmt {
+	this.partial = true
+	return this
+}
+
+func (this batchStmt) Exec(conn Conn) ([]*kissdif.BulkResult, error) {
+	if len(this.items) == 0 {
+		return []*kissdif.BulkResult{}, nil
+	}
+	impl, _ := this.items[0].batchItem()
+	bulk := &kissdif.Bulk{Partial: this.partial}
+	for _, item := range this.items {
+		other, record := item.batchItem()
+		if other.Db_ != impl.Db_ || other.Table_ != impl.Table_ {
+			return nil, kissdif.NewError(kissdif.EBadParam, "name", "table", "value", other.Table_)
+		}
+		if record.Id == "" {
+			return nil, kissdif.NewError(kissdif.EBadParam, "name", "id", "value", record.Id)
+		}
+		bulk.Records = append(bulk.Records, &record)
+	}
+	results, err := conn.PutMany(impl, bulk)
+	if err != nil {
+		return nil, ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
+	}
+	return results, nil
+}
+
 func (this deleteStmt) Exec(conn Conn) error {
 	err := conn.Delete(this.QueryImpl)
 	return ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
 }
 
+func (this dropTableStmt) Exec(conn Conn) error {
+	err := conn.DropTable(this.QueryImpl)
+	return ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
+}
+
+func (this changesStmt) Exec(conn Conn) (*kissdif.ChangeSet, error) {
+	return this.ExecContext(context.Background(), conn)
+}
+
+func (this changesStmt) ExecContext(ctx context.Context, conn Conn) (*kissdif.ChangeSet, error) {
+	result, err := conn.Changes(ctx, this.QueryImpl, this.since, 0)
+	if err != nil {
+		return nil, ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
+	}
+	return result, nil
+}
+
+func (this subscribeStmt) Exec(conn Conn) Subscription {
+	return newSubscription(conn, this.QueryImpl, this.since)
+}
+
 func (this QueryImpl) Exec(conn Conn) (ResultSet, error) {
-	result, err := conn.Get(this)
+	return this.ExecContext(context.Background(), conn)
+}
+
+func (this QueryImpl) ExecContext(ctx context.Context, conn Conn) (ResultSet, error) {
+	result, err := conn.Get(ctx, this)
 	return result, ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
 }
 
 func (this getStmt) Exec(conn Conn) (Record, error) {
+	return this.ExecContext(context.Background(), conn)
+}
+
+func (this getStmt) ExecContext(ctx context.Context, conn Conn) (Record, error) {
 	if conn == nil {
 		return nil, kissdif.NewError(kissdif.EBadParam, "name", "conn", "value", conn)
 	}
-	resultSet, err := conn.Get(this.QueryImpl)
+	resultSet, err := conn.Get(ctx, this.QueryImpl)
 	if err != nil {
 		return nil, ergo.Chain(err, kissdif.NewError(kissdif.EGeneric))
 	}
 	reader := resultSet.Reader()
+	defer reader.Close()
 	if !reader.Next() {
+		if reader.Err() != nil {
+			return nil, reader.Err()
+		}
 		return nil, kissdif.NewError(kissdif.ENotFound)
 	}
+	record := reader.Record()
 	if reader.Next() || resultSet.More() {
 		return nil, kissdif.NewError(kissdif.EMultiple)
 	}
-	return reader.Record(), nil
+	if reader.Err() != nil {
+		return nil, reader.Err()
+	}
+	return record, nil
 }
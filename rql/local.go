@@ -1,10 +1,14 @@
 package rql
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/flaub/ergo"
 	"github.com/flaub/kissdif"
 	"github.com/flaub/kissdif/driver"
-	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
 type localConn struct {
@@ -24,76 +28,353 @@ func (this *localConn) getDb(name string) driver.Database {
 	return this.dbs[name]
 }
 
-func (this *localConn) putDb(name string, db driver.Database) {
+func (this *localConn) CreateDB(name, driverName string, config kissdif.Dictionary) (Database, error) {
+	drv, kerr := driver.Open(driverName)
+	if kerr != nil {
+		return nil, kerr
+	}
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
+	if _, ok := this.dbs[name]; ok {
+		return nil, kissdif.NewError(kissdif.EConflict, "name", name)
+	}
+	db, kerr := drv.Configure(name, config)
+	if kerr != nil {
+		return nil, kerr
+	}
 	this.dbs[name] = db
+	return newQuery(name), nil
 }
 
-func (this *localConn) CreateDB(name, driverName string, config kissdif.Dictionary) (Database, error) {
-	drv, err := driver.Open(driverName)
+func (this *localConn) DropDB(name string) error {
+	this.mutex.Lock()
+	db, ok := this.dbs[name]
+	delete(this.dbs, name)
+	this.mutex.Unlock()
+	if !ok {
+		return kissdif.NewError(kissdif.EBadDatabase, "name", name)
+	}
+	err := db.Drop()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *localConn) DropTable(impl QueryImpl) error {
+	db := this.getDb(impl.Db_)
+	if db == nil {
+		return kissdif.NewError(kissdif.EBadDatabase, "name", impl.Db_)
+	}
+	err := db.DropTable(impl.Table_)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *localConn) ListDBs() ([]kissdif.DatabaseCfg, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	names := []string{}
+	for name := range this.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []kissdif.DatabaseCfg{}
+	for _, name := range names {
+		db := this.dbs[name]
+		result = append(result, kissdif.DatabaseCfg{
+			Name:   db.Name(),
+			Driver: db.Driver(),
+			Config: db.Config(),
+		})
+	}
+	return result, nil
+}
+
+func (this *localConn) ListTables(name string) ([]string, error) {
+	db := this.getDb(name)
+	if db == nil {
+		return nil, kissdif.NewError(kissdif.EBadDatabase, "name", name)
+	}
+	names, err := db.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (this *localConn) ListIndexes(dbName, tableName string) ([]string, error) {
+	db := this.getDb(dbName)
+	if db == nil {
+		return nil, kissdif.NewError(kissdif.EBadDatabase, "name", dbName)
+	}
+	table, err := db.GetTable(tableName, false)
 	if err != nil {
 		return nil, err
 	}
-	db, err := drv.Configure(name, config)
+	names, err := table.ListIndexes()
 	if err != nil {
 		return nil, err
 	}
-	this.putDb(name, db)
-	return newQuery(name), nil
+	return names, nil
 }
 
-func (this *localConn) DropDB(name string) error {
-	return kissdif.NewError(http.StatusNotImplemented, "Not implemented")
+func (this *localConn) DefineIndex(dbName, tableName string, def *kissdif.IndexDef) error {
+	db := this.getDb(dbName)
+	if db == nil {
+		return kissdif.NewError(kissdif.EBadDatabase, "name", dbName)
+	}
+	table, err := db.GetTable(tableName, true)
+	if err != nil {
+		return err
+	}
+	err = table.DefineIndex(def)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *localConn) ListIndexDefs(dbName, tableName string) ([]*kissdif.IndexDef, error) {
+	db := this.getDb(dbName)
+	if db == nil {
+		return nil, kissdif.NewError(kissdif.EBadDatabase, "name", dbName)
+	}
+	table, err := db.GetTable(tableName, false)
+	if err != nil {
+		return nil, err
+	}
+	defs, err := table.ListIndexDefs()
+	if err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+func (this *localConn) Changes(ctx context.Context, impl QueryImpl, since uint64, wait time.Duration) (*kissdif.ChangeSet, error) {
+	table, err := this.getTable(impl, false)
+	if err != nil {
+		return nil, err
+	}
+	result, kerr := driver.WaitChanges(ctx, table, since, wait)
+	if kerr != nil {
+		return nil, kerr
+	}
+	return result, nil
 }
 
-func (this *localConn) Get(impl QueryImpl) (*kissdif.ResultSet, error) {
+func (this *localConn) getTable(impl QueryImpl, create bool) (driver.Table, error) {
 	db := this.getDb(impl.Db_)
 	if db == nil {
-		return nil, kissdif.NewError(http.StatusNotFound, "DB not found")
+		return nil, kissdif.NewError(kissdif.EBadDatabase, "name", impl.Db_)
 	}
-	table, err := db.GetTable(impl.Table_, false)
+	table, err := db.GetTable(impl.Table_, create)
 	if err != nil {
 		return nil, err
 	}
-	ch, err := table.Get(&impl.Query_)
+	return table, nil
+}
+
+// newRecordImpl copies a driver record into the form used by the HTTP
+// connection so that callers observe the same semantics in both modes.
+func newRecordImpl(record *kissdif.Record) (*RecordImpl, error) {
+	doc, err := json.Marshal(record.Doc)
+	if err != nil {
+		return nil, ergo.Wrap(err)
+	}
+	result := &RecordImpl{
+		Id_:      record.Id,
+		Rev_:     record.Rev,
+		Doc_:     doc,
+		Deleted_: record.Deleted,
+		cursor:   record.Cursor,
+	}
+	if len(record.Keys) != 0 {
+		result.Keys_ = make(kissdif.IndexMap)
+		for name, keys := range record.Keys {
+			result.Keys_[name] = append([]string(nil), keys...)
+		}
+	}
+	return result, nil
+}
+
+func (this *localConn) Get(ctx context.Context, impl QueryImpl) (ResultSet, error) {
+	table, err := this.getTable(impl, false)
 	if err != nil {
 		return nil, err
 	}
-	result := &kissdif.ResultSet{
-		More:    true,
-		Records: []*kissdif.Record{},
+	ctx, cancel := context.WithCancel(ctx)
+	ctx, failure := driver.WithFailure(ctx)
+	ch, kerr := table.Get(ctx, &impl.Query_)
+	if kerr != nil {
+		cancel()
+		return nil, kerr
+	}
+	return newResultSet(ctx, cancel, ch, failure)
+}
+
+// newResultSet reads the records sent by a driver as they are asked for.
+// The driver's query runs until ctx is done, which cancel brings about,
+// and reports an error that ends it early to failure.
+func newResultSet(ctx context.Context, cancel context.CancelFunc, ch chan (*kissdif.Record),
+	failure *driver.Failure) (ResultSet, error) {
+	src := &chanSource{ctx: ctx, cancel: cancel, ch: ch, failure: failure, more: true}
+	return newStreamResultSet(src), nil
+}
+
+// chanSource is a recordSource reading from a driver's channel.
+type chanSource struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	ch      chan (*kissdif.Record)
+	failure *driver.Failure
+	more    bool
+	cursor  string
+}
+
+func (this *chanSource) next() (*RecordImpl, bool, string, error) {
+	if this.ctx.Err() != nil {
+		return nil, false, "", this.ctx.Err()
 	}
-	for record := range ch {
+	for record := range this.ch {
 		if record == nil {
-			result.More = false
-		} else {
-			result.Records = append(result.Records, record)
+			this.more = false
+			continue
 		}
+		this.cursor = record.Cursor
+		item, err := newRecordImpl(record)
+		if err != nil {
+			return nil, false, "", err
+		}
+		return item, false, "", nil
+	}
+	if this.failure.Err() != nil {
+		return nil, false, "", this.failure.Err()
+	}
+	// the driver stops early, without saying so, when ctx is done
+	if this.more && this.ctx.Err() != nil {
+		return nil, false, "", this.ctx.Err()
+	}
+	if !this.more {
+		this.cursor = ""
+	}
+	return nil, this.more, this.cursor, nil
+}
+
+// close stops the query and waits for the driver to let go of it.
+func (this *chanSource) close() {
+	this.cancel()
+	for _ = range this.ch {
 	}
-	return result, nil
 }
 
 func (this *localConn) Put(impl QueryImpl) (string, error) {
-	db := this.getDb(impl.Db_)
-	if db == nil {
-		return "", kissdif.NewError(http.StatusNotFound, "DB not found")
+	record := impl.Record_
+	if record.Id == "" {
+		return "", kissdif.NewError(kissdif.EBadParam, "name", "id", "value", record.Id)
 	}
-	table, err := db.GetTable(impl.Table_, true)
+	table, err := this.getTable(impl, true)
 	if err != nil {
 		return "", err
 	}
-	return table.Put(&impl.Record_)
+	record.Keys = record.Keys.Clone()
+	rev, kerr := table.Put(&record)
+	if kerr != nil {
+		return "", kerr
+	}
+	return rev, nil
 }
 
 func (this *localConn) Delete(impl QueryImpl) error {
-	db := this.getDb(impl.Db_)
-	if db == nil {
-		return kissdif.NewError(http.StatusNotFound, "DB not found")
-	}
-	table, err := db.GetTable(impl.Table_, false)
+	table, err := this.getTable(impl, false)
 	if err != nil {
 		return err
 	}
-	return table.Delete(impl.Record_.Id)
+	_, kerr := table.Delete(impl.Record_.Id, impl.Record_.Rev)
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
+func (this *localConn) PutMany(impl QueryImpl, bulk *kissdif.Bulk) ([]*kissdif.BulkResult, error) {
+	table, err := this.getTable(impl, true)
+	if err != nil {
+		return nil, err
+	}
+	results, kerr := table.PutMany(bulk.Records, !bulk.Partial)
+	if kerr != nil {
+		return nil, kerr
+	}
+	return results, nil
+}
+
+func (this *localConn) Tx(fn func(tx Conn) error) error {
+	return runTx(this, this.begin, fn)
+}
+
+func (this *localConn) begin(name string) (txn, error) {
+	db := this.getDb(name)
+	if db == nil {
+		return nil, kissdif.NewError(kissdif.EBadDatabase, "name", name)
+	}
+	tx, kerr := db.Begin()
+	if kerr != nil {
+		return nil, kerr
+	}
+	return &localTxn{tx}, nil
+}
+
+type localTxn struct {
+	tx driver.Tx
+}
+
+func (this *localTxn) Get(ctx context.Context, impl QueryImpl) (ResultSet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ctx, failure := driver.WithFailure(ctx)
+	ch, kerr := this.tx.Get(ctx, impl.Table_, &impl.Query_)
+	if kerr != nil {
+		cancel()
+		return nil, kerr
+	}
+	return newResultSet(ctx, cancel, ch, failure)
+}
+
+func (this *localTxn) Put(impl QueryImpl) (string, error) {
+	record := impl.Record_
+	if record.Id == "" {
+		return "", kissdif.NewError(kissdif.EBadParam, "name", "id", "value", record.Id)
+	}
+	record.Keys = record.Keys.Clone()
+	rev, kerr := this.tx.Put(impl.Table_, &record)
+	if kerr != nil {
+		return "", kerr
+	}
+	return rev, nil
+}
+
+func (this *localTxn) Delete(impl QueryImpl) (string, error) {
+	rev, kerr := this.tx.Delete(impl.Table_, impl.Record_.Id, impl.Record_.Rev)
+	if kerr != nil {
+		return "", kerr
+	}
+	return rev, nil
+}
+
+func (this *localTxn) Commit() error {
+	kerr := this.tx.Commit()
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
+func (this *localTxn) Rollback() error {
+	kerr := this.tx.Rollback()
+	if kerr != nil {
+		return kerr
+	}
+	return nil
 }
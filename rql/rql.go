@@ -1,13 +1,16 @@
 package rql
 
 import (
+	"context"
 	"github.com/flaub/kissdif"
 	"net/http"
 	_url "net/url"
+	"time"
 )
 
 type ResultSet interface {
 	More() bool
+	Cursor() string
 	Count() int
 	Reader() RecordReader
 }
@@ -17,12 +20,17 @@ type RecordReader interface {
 	Record() Record
 	Scan(into interface{}) (interface{}, error)
 	MustScan(into interface{}) interface{}
+	// Err returns the error that stopped Next early, if any.
+	Err() error
+	// Close releases a result that won't be read to the end.
+	Close() error
 }
 
 type Record interface {
 	Id() string
 	Rev() string
 	Keys() kissdif.IndexMap
+	Deleted() bool
 
 	Scan(into interface{}) (interface{}, error)
 	MustScan(into interface{}) interface{}
@@ -34,9 +42,29 @@ type Record interface {
 type Conn interface {
 	CreateDB(name, driver string, config kissdif.Dictionary) (Database, error)
 	DropDB(name string) error
-	Get(impl QueryImpl) (ResultSet, error)
+	DropTable(impl QueryImpl) error
+	ListDBs() ([]kissdif.DatabaseCfg, error)
+	ListTables(db string) ([]string, error)
+	ListIndexes(db, table string) ([]string, error)
+	// DefineIndex makes the table compute the keys of an index from its
+	// documents, including those already there.
+	DefineIndex(db, table string, def *kissdif.IndexDef) error
+	ListIndexDefs(db, table string) ([]*kissdif.IndexDef, error)
+	// Get runs the query until ctx is done; the result can't be read any
+	// further after that.
+	Get(ctx context.Context, impl QueryImpl) (ResultSet, error)
 	Put(impl QueryImpl) (string, error)
 	Delete(impl QueryImpl) error
+	// PutMany writes the records to the table of impl in one request.
+	PutMany(impl QueryImpl, bulk *kissdif.Bulk) ([]*kissdif.BulkResult, error)
+	// Tx runs fn within a transaction, which is committed if fn returns
+	// nil and rolled back otherwise. The statements executed on tx must
+	// all use the same database; only their gets, puts and deletes are part
+	// of the transaction.
+	Tx(fn func(tx Conn) error) error
+	// Changes returns the changes after since, waiting up to wait for the
+	// first one when there are none yet, or until ctx is done.
+	Changes(ctx context.Context, impl QueryImpl, since uint64, wait time.Duration) (*kissdif.ChangeSet, error)
 }
 
 type Database interface {
@@ -50,21 +78,63 @@ type ExecStmt interface {
 
 type SingleStmt interface {
 	Exec(conn Conn) (Record, error)
+	ExecContext(ctx context.Context, conn Conn) (Record, error)
+}
+
+// BatchItem is a write that can be gathered into a Batch.
+type BatchItem interface {
+	batchItem() (QueryImpl, kissdif.Record)
 }
 
 type PutStmt interface {
+	BatchItem
 	Exec(conn Conn) (string, error)
 	By(key, value string) PutStmt
 	Keys(keys kissdif.IndexMap) PutStmt
 }
 
+type DeleteStmt interface {
+	BatchItem
+	ExecStmt
+}
+
+type BatchStmt interface {
+	Exec(conn Conn) ([]*kissdif.BulkResult, error)
+	// Partial lets each write succeed or fail on its own, instead of
+	// making none of them when one fails.
+	Partial() BatchStmt
+}
+
+type ChangesStmt interface {
+	Exec(conn Conn) (*kissdif.ChangeSet, error)
+	ExecContext(ctx context.Context, conn Conn) (*kissdif.ChangeSet, error)
+}
+
+type SubscribeStmt interface {
+	Exec(conn Conn) Subscription
+}
+
+// Subscription delivers the changes to a table as they happen.
+type Subscription interface {
+	// Changes is closed after Close is called or an error occurs.
+	Changes() <-chan *kissdif.Change
+	// Err returns the error that ended the subscription, if any.
+	Err() error
+	Close()
+}
+
 type MultiStmt interface {
 	Exec(conn Conn) (ResultSet, error)
+	// ExecContext is like Exec, but the query is cancelled once ctx is
+	// done, even while its result is being read.
+	ExecContext(ctx context.Context, conn Conn) (ResultSet, error)
 }
 
 type Limitable interface {
 	MultiStmt
 	Limit(count uint) Query
+	After(cursor string) Limitable
+	Reverse() Limitable
 }
 
 type Query interface {
@@ -72,6 +142,7 @@ type Query interface {
 	Get(key string) SingleStmt
 	GetAll(key string) Limitable
 	Between(lower, upper string) Limitable
+	WithDeleted() Query
 }
 
 type Indexable interface {
@@ -83,11 +154,18 @@ type Table interface {
 	Indexable
 	Insert(id string, doc interface{}) PutStmt
 	Update(id, rev string, doc interface{}) PutStmt
-	Delete(id, rev string) ExecStmt
+	Delete(id, rev string) DeleteStmt
 	UpdateRecord(record Record) PutStmt
-	DeleteRecord(record Record) ExecStmt
+	DeleteRecord(record Record) DeleteStmt
+	Changes(since uint64) ChangesStmt
+	Subscribe(since uint64) SubscribeStmt
 }
 
+// Connect opens a connection to a server at an http or https URL, or to
+// databases within this process with "local://". The format parameter of
+// an http URL picks the wire format, either "json" (the default) or
+// "msgpack". Credentials are given as the user and password of the URL,
+// or as a bearer token in its token parameter.
 func Connect(url string) (Conn, error) {
 	theUrl, err := _url.Parse(url)
 	if err != nil {
@@ -95,9 +173,25 @@ func Connect(url string) (Conn, error) {
 	}
 	switch theUrl.Scheme {
 	case "http", "https":
-		return newHttpConn(url), nil
-	// case "local":
-	// 	return newLocalConn(), nil
+		name := theUrl.Query().Get("format")
+		if name == "" {
+			name = "json"
+		}
+		formatter, ok := formatters[name]
+		if !ok {
+			return nil, kissdif.NewError(kissdif.EBadParam, "name", "format", "value", name)
+		}
+		// credentials are sent with each request rather than in the URL
+		token := theUrl.Query().Get("token")
+		user := theUrl.User
+		theUrl.User = nil
+		theUrl.RawQuery = ""
+		conn := newHttpConn(theUrl.String(), formatter)
+		conn.user = user
+		conn.token = token
+		return conn, nil
+	case "local":
+		return newLocalConn(), nil
 	default:
 		return nil, kissdif.NewError(http.StatusBadRequest, "Unrecognized connection scheme")
 	}
@@ -106,3 +200,9 @@ func Connect(url string) (Conn, error) {
 func DB(name string) Database {
 	return newQuery(name)
 }
+
+// Batch gathers inserts, updates and deletes of records in a single table
+// so that they are written together.
+func Batch(items ...BatchItem) BatchStmt {
+	return batchStmt{items: items}
+}
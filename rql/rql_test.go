@@ -1,12 +1,15 @@
 package rql
 
 import (
+	"context"
 	"github.com/flaub/kissdif"
 	_ "github.com/flaub/kissdif/driver/mem"
 	"github.com/flaub/kissdif/server"
 	. "github.com/motain/gocheck"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -21,13 +24,23 @@ type TestHttpSuite struct {
 	ts *httptest.Server
 }
 
+type TestMsgpackSuite struct {
+	TestHttpSuite
+}
+
+type TestAuthSuite struct {
+	TestHttpSuite
+}
+
 type TestLocalSuite struct {
 	TestSuite
 }
 
 var (
-	// _ = Suite(new(TestLocalSuite))
+	_ = Suite(new(TestLocalSuite))
 	_ = Suite(new(TestHttpSuite))
+	_ = Suite(new(TestMsgpackSuite))
+	_ = Suite(new(TestAuthSuite))
 )
 
 func (this *TestHttpSuite) SetUpTest(c *C) {
@@ -41,6 +54,25 @@ func (this *TestHttpSuite) TearDownTest(c *C) {
 	this.ts.Close()
 }
 
+func (this *TestMsgpackSuite) SetUpTest(c *C) {
+	this.ts = httptest.NewServer(server.NewServer().Server.Handler)
+	var err error
+	this.conn, err = Connect(this.ts.URL + "?format=msgpack")
+	c.Check(err, IsNil)
+}
+
+func (this *TestAuthSuite) SetUpTest(c *C) {
+	srv := server.NewServer()
+	users := server.Credentials{
+		"user": {Salt: "salt", Hash: server.HashPasswordCost("salt", "pass", 10), Roles: map[string]string{"*": "admin"}},
+	}
+	srv.SetAuth(users, &server.BasicAuth{Users: users})
+	this.ts = httptest.NewServer(srv.Server.Handler)
+	var err error
+	this.conn, err = Connect(strings.Replace(this.ts.URL, "http://", "http://user:pass@", 1))
+	c.Check(err, IsNil)
+}
+
 func (this *TestLocalSuite) SetUpTest(c *C) {
 	var err error
 	this.conn, err = Connect("local://")
@@ -150,6 +182,38 @@ func (this *TestSuite) TestIndex(c *C) {
 	c.Check(doc, Equals, "Other")
 }
 
+func (this *TestSuite) TestIndexDef(c *C) {
+	type user struct {
+		Name  string
+		Email string
+	}
+	table := DB("db").Table("table")
+	_, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Assert(err, IsNil)
+	_, err = table.Insert("1", &user{Name: "Joe", Email: "joe@x"}).Exec(this.conn)
+	c.Assert(err, IsNil)
+
+	c.Assert(this.conn.DefineIndex("db", "table", &kissdif.IndexDef{Name: "email", Path: "/Email"}), IsNil)
+	_, err = table.Insert("2", &user{Name: "Bob", Email: "bob@x"}).Exec(this.conn)
+	c.Assert(err, IsNil)
+
+	var doc user
+	result, err := table.By("email").Get("joe@x").Exec(this.conn)
+	c.Assert(err, IsNil)
+	result.MustScan(&doc)
+	c.Check(doc.Name, Equals, "Joe")
+	result, err = table.By("email").Get("bob@x").Exec(this.conn)
+	c.Assert(err, IsNil)
+	result.MustScan(&doc)
+	c.Check(doc.Name, Equals, "Bob")
+
+	defs, err := this.conn.ListIndexDefs("db", "table")
+	c.Assert(err, IsNil)
+	c.Check(defs, DeepEquals, []*kissdif.IndexDef{{Name: "email", Path: "/Email"}})
+	err = this.conn.DefineIndex("db", "table", &kissdif.IndexDef{Name: "bad", Path: "Email"})
+	c.Check(kissdif.IsError(err, kissdif.EBadParam), Equals, true)
+}
+
 func (this *TestSuite) insert(c *C, key, value string, keys kissdif.IndexMap) string {
 	table := DB("db").Table("table")
 	put := table.Insert(key, value)
@@ -333,3 +397,491 @@ func (this *TestSuite) TestUpdateKeys(c *C) {
 	c.Check(record.Keys()[key1], DeepEquals, []string{kv1})
 	c.Check(record.Keys()[key2], DeepEquals, []string{kv2})
 }
+
+func (this *TestSuite) TestDropDB(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	this.insert(c, "1", "1", nil)
+
+	err = this.conn.DropDB("db")
+	c.Check(err, IsNil)
+
+	_, err = table.Get("1").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.EBadDatabase), Equals, true)
+
+	err = this.conn.DropDB("db")
+	c.Check(kissdif.IsError(err, kissdif.EBadDatabase), Equals, true)
+}
+
+func (this *TestSuite) TestDropTable(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	this.insert(c, "1", "1", nil)
+
+	err = db.DropTable("table").Exec(this.conn)
+	c.Check(err, IsNil)
+
+	_, err = table.Get("1").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.EBadTable), Equals, true)
+
+	err = db.DropTable("table").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.EBadTable), Equals, true)
+}
+
+func (this *TestSuite) TestCatalog(c *C) {
+	_, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	_, err = this.conn.CreateDB("other", "mem", kissdif.Dictionary{"key": "value"})
+	c.Check(err, IsNil)
+	_, err = this.conn.CreateDB("other", "mem", kissdif.Dictionary{})
+	c.Check(kissdif.IsError(err, kissdif.EConflict), Equals, true)
+
+	dbs, err := this.conn.ListDBs()
+	c.Check(err, IsNil)
+	c.Check(len(dbs), Equals, 2)
+	c.Check(dbs[0].Name, Equals, "db")
+	c.Check(dbs[0].Driver, Equals, "mem")
+	c.Check(dbs[1].Name, Equals, "other")
+	c.Check(dbs[1].Config["key"], Equals, "value")
+
+	tables, err := this.conn.ListTables("db")
+	c.Check(err, IsNil)
+	c.Check(tables, DeepEquals, []string{})
+
+	this.insert(c, "1", "1", kissdif.IndexMap{"name": []string{"Alice"}})
+
+	tables, err = this.conn.ListTables("db")
+	c.Check(err, IsNil)
+	c.Check(tables, DeepEquals, []string{"table"})
+
+	indexes, err := this.conn.ListIndexes("db", "table")
+	c.Check(err, IsNil)
+	c.Check(indexes, DeepEquals, []string{"_id", "name"})
+
+	_, err = this.conn.ListTables("missing")
+	c.Check(kissdif.IsError(err, kissdif.EBadDatabase), Equals, true)
+
+	_, err = this.conn.ListIndexes("db", "missing")
+	c.Check(kissdif.IsError(err, kissdif.EBadTable), Equals, true)
+}
+
+func (this *TestSuite) TestDeleteConflict(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	rev := this.insert(c, "1", "1", nil)
+
+	err = table.Delete("1", "xxx").Exec(this.conn)
+	c.Check(kissdif.IsConflict(err), Equals, true)
+
+	record, err := table.Get("1").Exec(this.conn)
+	c.Check(err, IsNil)
+	c.Check(record.Rev(), Equals, rev)
+
+	err = table.DeleteRecord(record).Exec(this.conn)
+	c.Check(err, IsNil)
+
+	_, err = table.Get("1").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.ENotFound), Equals, true)
+}
+
+func (this *TestSuite) TestDeleteMissing(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	err = table.Delete("1", "").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.EBadTable), Equals, true)
+
+	rev := this.insert(c, "1", "a", nil)
+	err = table.Delete("2", "").Exec(this.conn)
+	c.Check(err, IsNil)
+
+	err = table.Delete("1", rev).Exec(this.conn)
+	c.Check(err, IsNil)
+
+	err = table.Delete("1", rev).Exec(this.conn)
+	c.Check(err, IsNil)
+
+	_, err = table.Update("1", rev, "b").Exec(this.conn)
+	c.Check(kissdif.IsConflict(err), Equals, true)
+
+	_, err = table.Update("2", rev, "b").Exec(this.conn)
+	c.Check(kissdif.IsConflict(err), Equals, true)
+
+	record, err := table.WithDeleted().Get("1").Exec(this.conn)
+	c.Assert(err, IsNil)
+	_, err = table.Update("1", record.Rev(), "b").Exec(this.conn)
+	c.Check(err, IsNil)
+}
+
+type numberDoc struct {
+	Count int
+	Ratio float64
+	Sizes []int64
+}
+
+func (this *TestSuite) TestNumbers(c *C) {
+	table := DB("db").Table("table")
+	_, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Assert(err, IsNil)
+
+	_, err = table.Insert("int", 42).Exec(this.conn)
+	c.Assert(err, IsNil)
+	record, err := table.Get("int").Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(record.MustScan(new(int)), DeepEquals, newInt(42))
+
+	data := &numberDoc{Count: 3, Ratio: 0.5, Sizes: []int64{1, -2, 1 << 40}}
+	_, err = table.Insert("doc", data).Exec(this.conn)
+	c.Assert(err, IsNil)
+	record, err = table.Get("doc").Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(record.MustScan(&numberDoc{}), DeepEquals, data)
+}
+
+func (this *TestSuite) TestCursor(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		this.insert(c, id, id, kissdif.IndexMap{"group": []string{"all"}})
+	}
+
+	actual := []string{}
+	rs, err := table.By("group").GetAll("all").Limit(2).Exec(this.conn)
+	for {
+		c.Assert(err, IsNil)
+		reader := rs.Reader()
+		for reader.Next() {
+			doc := ""
+			reader.MustScan(&doc)
+			actual = append(actual, doc)
+		}
+		if !rs.More() {
+			c.Check(rs.Cursor(), Equals, "")
+			break
+		}
+		c.Assert(rs.Cursor(), Not(Equals), "")
+		rs, err = table.By("group").GetAll("all").After(rs.Cursor()).Limit(2).Exec(this.conn)
+	}
+	c.Check(actual, DeepEquals, []string{"1", "2", "3", "4", "5"})
+}
+
+func (this *TestSuite) TestStream(c *C) {
+	table := DB("db").Table("table")
+	_, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Assert(err, IsNil)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		this.insert(c, id, id, nil)
+	}
+
+	rs, err := table.Limit(3).Exec(this.conn)
+	c.Assert(err, IsNil)
+	reader := rs.Reader()
+	actual := []string{}
+	for reader.Next() {
+		actual = append(actual, reader.Record().Id())
+	}
+	c.Check(reader.Err(), IsNil)
+	c.Check(actual, DeepEquals, []string{"1", "2", "3"})
+	c.Check(rs.Count(), Equals, 3)
+	c.Check(rs.More(), Equals, true)
+	c.Check(rs.Cursor(), Not(Equals), "")
+
+	// a result that is closed early leaves the table usable
+	rs, err = table.Limit(3).Exec(this.conn)
+	c.Assert(err, IsNil)
+	reader = rs.Reader()
+	c.Assert(reader.Next(), Equals, true)
+	c.Check(reader.Close(), IsNil)
+	c.Check(reader.Next(), Equals, false)
+	this.insert(c, "5", "5", nil)
+}
+
+func (this *TestSuite) TestUpdateWhileReading(c *C) {
+	table := DB("db").Table("table")
+	_, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Assert(err, IsNil)
+	for _, id := range []string{"1", "2", "3"} {
+		this.insert(c, id, id, nil)
+	}
+
+	rs, err := table.Limit(10).Exec(this.conn)
+	c.Assert(err, IsNil)
+	reader := rs.Reader()
+	actual := []string{}
+	for reader.Next() {
+		record := reader.Record()
+		_, err = table.Update(record.Id(), record.Rev(), "x").Exec(this.conn)
+		c.Assert(err, IsNil)
+		actual = append(actual, record.Id())
+	}
+	c.Check(reader.Err(), IsNil)
+	c.Check(actual, DeepEquals, []string{"1", "2", "3"})
+}
+
+func (this *TestSuite) TestExecContext(c *C) {
+	table := DB("db").Table("table")
+	_, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Assert(err, IsNil)
+	this.insert(c, "1", "1", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs, err := table.Limit(10).ExecContext(ctx, this.conn)
+	c.Assert(err, IsNil)
+	c.Check(rs.Count(), Equals, 1)
+
+	cancel()
+	rs, err = table.Limit(10).ExecContext(ctx, this.conn)
+	if err == nil {
+		// a local query only notices once its result is read
+		reader := rs.Reader()
+		c.Check(reader.Next(), Equals, false)
+		err = reader.Err()
+	}
+	c.Check(err, NotNil)
+}
+
+func (this *TestSuite) TestReverse(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		this.insert(c, id, id, nil)
+	}
+
+	rs, err := table.Between("2", "5").Reverse().Limit(2).Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(rs.More(), Equals, true)
+	actual := []string{}
+	reader := rs.Reader()
+	for reader.Next() {
+		doc := ""
+		reader.MustScan(&doc)
+		actual = append(actual, doc)
+	}
+	c.Check(actual, DeepEquals, []string{"4", "3"})
+}
+
+func (this *TestSuite) TestChanges(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	this.insert(c, "1", "a", nil)
+	rev := this.insert(c, "2", "b", nil)
+	err = table.Delete("2", rev).Exec(this.conn)
+	c.Assert(err, IsNil)
+
+	result, err := table.Changes(0).Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(result.LastSeq, Equals, uint64(3))
+	c.Assert(result.Changes, HasLen, 2)
+	c.Check(result.Changes[0].Id, Equals, "1")
+	c.Check(result.Changes[0].Deleted, Equals, false)
+	c.Check(result.Changes[1].Id, Equals, "2")
+	c.Check(kissdif.CompareRevisions(result.Changes[1].Rev, rev), Equals, 1)
+	c.Check(result.Changes[1].Deleted, Equals, true)
+
+	result, err = table.Changes(3).Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(result.LastSeq, Equals, uint64(3))
+	c.Check(result.Changes, HasLen, 0)
+
+	_, err = DB("db").Table("missing").Changes(0).Exec(this.conn)
+	c.Check(err, NotNil)
+}
+
+func (this *TestSuite) TestSubscribe(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	// keep a closed subscription from holding the server open
+	defer func(timeout time.Duration) { pollTimeout = timeout }(pollTimeout)
+	pollTimeout = 100 * time.Millisecond
+
+	this.insert(c, "1", "a", nil)
+	sub := table.Subscribe(0).Exec(this.conn)
+	defer sub.Close()
+	change := <-sub.Changes()
+	c.Assert(change, NotNil)
+	c.Check(change.Id, Equals, "1")
+
+	this.insert(c, "2", "b", nil)
+	change = <-sub.Changes()
+	c.Assert(change, NotNil)
+	c.Check(change.Id, Equals, "2")
+	c.Check(change.Seq, Equals, uint64(2))
+
+	sub = DB("db").Table("missing").Subscribe(0).Exec(this.conn)
+	_, ok := <-sub.Changes()
+	c.Check(ok, Equals, false)
+	c.Check(sub.Err(), NotNil)
+}
+
+func (this *TestSuite) TestTombstone(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	rev := this.insert(c, "1", "a", nil)
+	err = table.Delete("1", rev).Exec(this.conn)
+	c.Assert(err, IsNil)
+
+	_, err = table.Get("1").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.ENotFound), Equals, true)
+
+	record, err := table.WithDeleted().Get("1").Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(record.Deleted(), Equals, true)
+	c.Check(kissdif.CompareRevisions(record.Rev(), rev), Equals, 1)
+
+	rs, err := table.WithDeleted().Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(rs.Count(), Equals, 1)
+	rs, err = table.Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(rs.Count(), Equals, 0)
+}
+
+func (this *TestSuite) TestBatch(c *C) {
+	table := DB("db").Table("table")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+
+	rev := this.insert(c, "1", "a", nil)
+	results, err := Batch(
+		table.Insert("2", "b").By("name", "Bob"),
+		table.Update("1", rev, "a2"),
+		table.Insert("3", "c"),
+	).Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	for _, result := range results {
+		c.Check(result.Err(), IsNil)
+		c.Check(result.Rev, Not(Equals), "")
+	}
+	record, err := table.By("name").Get("Bob").Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(record.Rev(), Equals, results[0].Rev)
+
+	// nothing is written when one write conflicts
+	_, err = Batch(
+		table.Delete("3", results[2].Rev),
+		table.Update("1", rev, "a3"),
+	).Exec(this.conn)
+	c.Check(kissdif.IsConflict(err), Equals, true)
+	_, err = table.Get("3").Exec(this.conn)
+	c.Check(err, IsNil)
+
+	results, err = Batch(
+		table.Delete("3", results[2].Rev),
+		table.Update("1", rev, "a3"),
+	).Partial().Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].Err(), IsNil)
+	c.Check(kissdif.IsConflict(results[1].Err()), Equals, true)
+	_, err = table.Get("3").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.ENotFound), Equals, true)
+
+	_, err = Batch(
+		table.Insert("4", "d"),
+		DB("db").Table("other").Insert("5", "e"),
+	).Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.EBadParam), Equals, true)
+}
+
+func (this *TestSuite) TestTx(c *C) {
+	orders := DB("db").Table("orders")
+	stock := DB("db").Table("stock")
+	db, err := this.conn.CreateDB("db", "mem", kissdif.Dictionary{})
+	c.Check(err, IsNil)
+	c.Check(db, NotNil)
+	rev, err := stock.Insert("widget", 5).Exec(this.conn)
+	c.Assert(err, IsNil)
+
+	err = this.conn.Tx(func(tx Conn) error {
+		_, err := orders.Insert("1", "widget").Exec(tx)
+		if err != nil {
+			return err
+		}
+		record, err := stock.Get("widget").Exec(tx)
+		if err != nil {
+			return err
+		}
+		record.MustSet(4)
+		_, err = stock.UpdateRecord(record).Exec(tx)
+		if err != nil {
+			return err
+		}
+		// reads see the transaction's own writes
+		record, err = stock.Get("widget").Exec(tx)
+		if err != nil {
+			return err
+		}
+		c.Check(record.MustScan(new(int)), DeepEquals, newInt(4))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	_, err = orders.Get("1").Exec(this.conn)
+	c.Check(err, IsNil)
+	record, err := stock.Get("widget").Exec(this.conn)
+	c.Assert(err, IsNil)
+	c.Check(record.MustScan(new(int)), DeepEquals, newInt(4))
+
+	// an error rolls back every write
+	err = this.conn.Tx(func(tx Conn) error {
+		_, err := orders.Insert("2", "widget").Exec(tx)
+		c.Check(err, IsNil)
+		_, err = stock.Update("widget", rev, 3).Exec(tx)
+		return err
+	})
+	c.Check(kissdif.IsConflict(err), Equals, true)
+	_, err = orders.Get("2").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.ENotFound), Equals, true)
+
+	err = this.conn.Tx(func(tx Conn) error {
+		_, err := orders.Insert("3", "widget").Exec(tx)
+		c.Check(err, IsNil)
+		_, err = DB("other").Table("orders").Get("3").Exec(tx)
+		return err
+	})
+	c.Check(kissdif.IsError(err, kissdif.EBadParam), Equals, true)
+
+	// a failed batch can't be committed, even when its error is ignored
+	err = this.conn.Tx(func(tx Conn) error {
+		_, err := Batch(
+			stock.Insert("gadget", 1),
+			stock.Update("widget", rev, 3),
+		).Exec(tx)
+		c.Check(kissdif.IsConflict(err), Equals, true)
+		return nil
+	})
+	c.Check(kissdif.IsConflict(err), Equals, true)
+	_, err = stock.Get("gadget").Exec(this.conn)
+	c.Check(kissdif.IsError(err, kissdif.ENotFound), Equals, true)
+}
+
+func newInt(value int) *int {
+	return &value
+}
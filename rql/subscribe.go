@@ -0,0 +1,75 @@
+package rql
+
+import (
+	"context"
+	"github.com/flaub/kissdif"
+	"sync"
+	"time"
+)
+
+// pollTimeout bounds each long-poll made by a subscription.
+var pollTimeout = 30 * time.Second
+
+type subscription struct {
+	ch      chan *kissdif.Change
+	done    chan struct{}
+	once    sync.Once
+	cancel  context.CancelFunc
+	timeout time.Duration
+	err     error
+}
+
+func newSubscription(conn Conn, impl QueryImpl, since uint64) *subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	this := &subscription{
+		ch:      make(chan *kissdif.Change),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+		timeout: pollTimeout,
+	}
+	go this.run(ctx, conn, impl, since)
+	return this
+}
+
+func (this *subscription) run(ctx context.Context, conn Conn, impl QueryImpl, since uint64) {
+	defer close(this.ch)
+	for {
+		result, err := conn.Changes(ctx, impl, since, this.timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			this.err = err
+			return
+		}
+		for _, change := range result.Changes {
+			select {
+			case this.ch <- change:
+			case <-this.done:
+				return
+			}
+		}
+		since = result.LastSeq
+		select {
+		case <-this.done:
+			return
+		default:
+		}
+	}
+}
+
+func (this *subscription) Changes() <-chan *kissdif.Change {
+	return this.ch
+}
+
+func (this *subscription) Err() error {
+	return this.err
+}
+
+// Close cancels any long-poll in progress.
+func (this *subscription) Close() {
+	this.once.Do(func() {
+		close(this.done)
+		this.cancel()
+	})
+}
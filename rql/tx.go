@@ -0,0 +1,157 @@
+package rql
+
+import (
+	"context"
+	"github.com/flaub/ergo"
+	"github.com/flaub/kissdif"
+	"sync"
+)
+
+// txn is a transaction begun on a connection.
+type txn interface {
+	Get(ctx context.Context, impl QueryImpl) (ResultSet, error)
+	Put(impl QueryImpl) (string, error)
+	Delete(impl QueryImpl) (string, error)
+	Commit() error
+	Rollback() error
+}
+
+// txConn runs gets, puts and deletes within a transaction, which is begun
+// on the database of the first of them. Everything else goes straight to
+// the connection the transaction runs on.
+type txConn struct {
+	Conn
+	begin func(db string) (txn, error)
+	db    string
+	txn   txn
+	// failed is the error of an all-or-nothing batch that failed part way,
+	// which keeps the transaction from being committed
+	failed error
+	mutex  sync.Mutex
+}
+
+func runTx(conn Conn, begin func(db string) (txn, error), fn func(tx Conn) error) error {
+	tx := &txConn{Conn: conn, begin: begin}
+	done := false
+	defer func() {
+		if !done {
+			tx.rollback()
+		}
+	}()
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	done = true
+	return tx.commit()
+}
+
+func (this *txConn) open(db string) (txn, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.txn == nil {
+		txn, err := this.begin(db)
+		if err != nil {
+			return nil, err
+		}
+		this.db = db
+		this.txn = txn
+	} else if db != this.db {
+		return nil, kissdif.NewError(kissdif.EBadParam, "name", "db", "value", db)
+	}
+	return this.txn, nil
+}
+
+func (this *txConn) commit() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.txn == nil {
+		return nil
+	}
+	if this.failed != nil {
+		this.txn.Rollback()
+		return this.failed
+	}
+	return this.txn.Commit()
+}
+
+func (this *txConn) rollback() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.txn != nil {
+		this.txn.Rollback()
+	}
+}
+
+func (this *txConn) Get(ctx context.Context, impl QueryImpl) (ResultSet, error) {
+	txn, err := this.open(impl.Db_)
+	if err != nil {
+		return nil, err
+	}
+	return txn.Get(ctx, impl)
+}
+
+func (this *txConn) Put(impl QueryImpl) (string, error) {
+	txn, err := this.open(impl.Db_)
+	if err != nil {
+		return "", err
+	}
+	return txn.Put(impl)
+}
+
+func (this *txConn) Delete(impl QueryImpl) error {
+	txn, err := this.open(impl.Db_)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Delete(impl)
+	return err
+}
+
+// PutMany makes the writes one at a time within the transaction. When the
+// batch isn't partial, the first failure is returned, and as the writes
+// made before it can't be undone on their own, the transaction is rolled
+// back instead of committed, failing with the same error.
+func (this *txConn) PutMany(impl QueryImpl, bulk *kissdif.Bulk) ([]*kissdif.BulkResult, error) {
+	txn, err := this.open(impl.Db_)
+	if err != nil {
+		return nil, err
+	}
+	results := []*kissdif.BulkResult{}
+	for _, record := range bulk.Records {
+		item := impl
+		item.Record_ = *record
+		result := &kissdif.BulkResult{Id: record.Id}
+		if record.Deleted {
+			result.Rev, err = txn.Delete(item)
+		} else {
+			result.Rev, err = txn.Put(item)
+		}
+		if err != nil {
+			if !bulk.Partial {
+				this.fail(err)
+				return nil, err
+			}
+			kerr, ok := err.(*ergo.Error)
+			if !ok {
+				kerr = ergo.Wrap(err)
+			}
+			result.Error = kerr
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (this *txConn) fail(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.failed == nil {
+		this.failed = err
+	}
+}
+
+// Tx runs fn within the same transaction.
+func (this *txConn) Tx(fn func(tx Conn) error) error {
+	return fn(this)
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/flaub/ergo"
+	"github.com/flaub/kissdif"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenTTL is how long a bearer token stays valid after it is issued.
+var tokenTTL = 24 * time.Hour
+
+const (
+	hashScheme = "pbkdf2-sha256"
+	// hashIterations is the cost of the hashes made by HashPassword.
+	hashIterations = 100000
+)
+
+// dummyHash is checked against when a user is unknown, so that the time
+// taken doesn't tell which users exist.
+var dummyHash = fmt.Sprintf("%s$%d$%s", hashScheme, hashIterations, strings.Repeat("0", 2*sha256.Size))
+
+// Role is what a user may do with a database. Each role allows everything
+// the ones before it do.
+type Role int
+
+const (
+	RoleNone   Role = iota
+	RoleReader      // list and read tables and documents
+	RoleWriter      // write documents and use transactions
+	RoleAdmin       // configure and drop the database and its tables
+)
+
+var roleNames = map[string]Role{
+	"reader": RoleReader,
+	"writer": RoleWriter,
+	"admin":  RoleAdmin,
+}
+
+// User is an entry of a credential file. Hash is the password hashed with
+// Salt, as returned by HashPassword. Roles maps database names, or "*" for
+// the others, to "reader", "writer" or "admin".
+type User struct {
+	Salt  string
+	Hash  string
+	Roles map[string]string
+}
+
+// Credentials are the users known to a server, by name.
+type Credentials map[string]*User
+
+// Authenticator identifies the user making a request. It returns "" when
+// the request carries no credentials of its kind, and EUnauthorized when
+// they are wrong.
+type Authenticator interface {
+	Authenticate(req *http.Request) (string, *ergo.Error)
+}
+
+// HashPassword returns "pbkdf2-sha256$<iterations>$<hex key>", where the
+// key is derived from the password and salt with PBKDF2-HMAC-SHA256.
+func HashPassword(salt, password string) string {
+	return HashPasswordCost(salt, password, hashIterations)
+}
+
+// HashPasswordCost is like HashPassword, with the given number of
+// iterations.
+func HashPasswordCost(salt, password string, iterations int) string {
+	key := pbkdf2([]byte(password), []byte(salt), iterations, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s", hashScheme, iterations, hex.EncodeToString(key))
+}
+
+// hashCost returns the number of iterations of a hash made by
+// HashPassword, or 0 if it isn't one.
+func hashCost(hash string) int {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != hashScheme {
+		return 0
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return 0
+	}
+	key, err := hex.DecodeString(parts[2])
+	if err != nil || len(key) != sha256.Size {
+		return 0
+	}
+	return iterations
+}
+
+// pbkdf2 derives a key of size bytes as RFC 8018 describes, with
+// HMAC-SHA256 as the pseudorandom function.
+func pbkdf2(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+// NewUser returns a user without roles whose password is hashed with a
+// random salt.
+func NewUser(password string) (*User, *ergo.Error) {
+	var raw [16]byte
+	_, err := rand.Read(raw[:])
+	if err != nil {
+		return nil, kissdif.Wrap(err)
+	}
+	salt := hex.EncodeToString(raw[:])
+	return &User{Salt: salt, Hash: HashPassword(salt, password), Roles: map[string]string{}}, nil
+}
+
+func LoadCredentials(path string) (Credentials, *ergo.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, kissdif.Wrap(err)
+	}
+	defer file.Close()
+	var users Credentials
+	err = json.NewDecoder(file).Decode(&users)
+	if err != nil {
+		return nil, kissdif.NewError(kissdif.EBadParam, "name", "credentials", "value", err.Error())
+	}
+	for name, user := range users {
+		if hashCost(user.Hash) == 0 {
+			return nil, kissdif.NewError(kissdif.EBadParam, "name", "hash", "value", name)
+		}
+		for _, role := range user.Roles {
+			if _, ok := roleNames[role]; !ok {
+				return nil, kissdif.NewError(kissdif.EBadParam, "name", "role", "value", role)
+			}
+		}
+	}
+	return users, nil
+}
+
+// Check reports whether password is the user's.
+func (this Credentials) Check(name, password string) bool {
+	salt, stored := "", dummyHash
+	user, ok := this[name]
+	if ok {
+		salt, stored = user.Salt, strings.ToLower(user.Hash)
+	}
+	iterations := hashCost(stored)
+	if iterations == 0 {
+		return false
+	}
+	hash := HashPasswordCost(salt, password, iterations)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1 && ok
+}
+
+// Role returns the user's role on the database.
+func (this Credentials) Role(name, db string) Role {
+	user, ok := this[name]
+	if !ok {
+		return RoleNone
+	}
+	role, ok := user.Roles[db]
+	if !ok {
+		role = user.Roles["*"]
+	}
+	return roleNames[role]
+}
+
+// BasicAuth checks HTTP Basic credentials against a credential file.
+type BasicAuth struct {
+	Users Credentials
+}
+
+func (this *BasicAuth) Authenticate(req *http.Request) (string, *ergo.Error) {
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	if !this.Users.Check(name, password) {
+		return "", kissdif.NewError(kissdif.EUnauthorized)
+	}
+	return name, nil
+}
+
+// TokenAuth checks bearer tokens, which are issued by the server to
+// authenticated users and signed with Key using HMAC-SHA256.
+type TokenAuth struct {
+	Key []byte
+}
+
+type tokenClaims struct {
+	User    string
+	Expires int64
+}
+
+func LoadTokenKey(path string) (*TokenAuth, *ergo.Error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, kissdif.Wrap(err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, kissdif.NewError(kissdif.EBadParam, "name", "token key", "value", path)
+	}
+	return &TokenAuth{Key: key}, nil
+}
+
+// Issue returns a token for the user that is valid for ttl.
+func (this *TokenAuth) Issue(user string, ttl time.Duration) string {
+	claims, _ := json.Marshal(&tokenClaims{User: user, Expires: time.Now().Add(ttl).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(this.sign(payload))
+}
+
+func (this *TokenAuth) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, this.Key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (this *TokenAuth) Authenticate(req *http.Request) (string, *ergo.Error) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", nil
+	}
+	parts := strings.Split(strings.TrimPrefix(header, "Bearer "), ".")
+	if len(parts) != 2 {
+		return "", kissdif.NewError(kissdif.EUnauthorized)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, this.sign(parts[0])) {
+		return "", kissdif.NewError(kissdif.EUnauthorized)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", kissdif.NewError(kissdif.EUnauthorized)
+	}
+	var claims tokenClaims
+	err = json.Unmarshal(raw, &claims)
+	if err != nil || claims.User == "" || time.Now().Unix() >= claims.Expires {
+		return "", kissdif.NewError(kissdif.EUnauthorized)
+	}
+	return claims.User, nil
+}
+
+// SetAuth makes the server require every request to be authenticated by
+// one of auths, and to be made by one of users with a role that allows
+// it. Without users, anyone may do anything.
+func (this *Server) SetAuth(users Credentials, auths ...Authenticator) {
+	this.users = users
+	this.auths = auths
+	this.tokens = nil
+	for _, auth := range auths {
+		if tokens, ok := auth.(*TokenAuth); ok {
+			this.tokens = tokens
+		}
+	}
+}
+
+// authenticate returns the user making the request.
+func (this *Server) authenticate(req *Request) (string, *ergo.Error) {
+	for _, auth := range this.auths {
+		name, kerr := auth.Authenticate(req.Request.Request)
+		if kerr != nil {
+			return "", kerr
+		}
+		if name != "" {
+			if _, ok := this.users[name]; !ok {
+				return "", kissdif.NewError(kissdif.EUnauthorized)
+			}
+			return name, nil
+		}
+	}
+	return "", kissdif.NewError(kissdif.EUnauthorized)
+}
+
+// authorize checks that the user making the request has at least the role
+// on the database.
+func (this *Server) authorize(req *Request, db string, role Role) *ergo.Error {
+	_, kerr := this.authorizeUser(req, db, role)
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
+// authorizeUser is like authorize, but also returns the user, which is ""
+// when anyone may do anything.
+func (this *Server) authorizeUser(req *Request, db string, role Role) (string, *ergo.Error) {
+	if this.users == nil {
+		return "", nil
+	}
+	name, kerr := this.authenticate(req)
+	if kerr != nil {
+		return "", kerr
+	}
+	if this.users.Role(name, db) < role {
+		return "", kissdif.NewError(kissdif.EForbidden, "name", db)
+	}
+	return name, nil
+}
+
+// postToken issues a bearer token to the user making the request.
+func (this *Server) postToken(resp *ResponseWriter, req *Request) interface{} {
+	if this.users == nil || this.tokens == nil {
+		return kissdif.NewError(kissdif.EBadRequest)
+	}
+	name, kerr := this.authenticate(req)
+	if kerr != nil {
+		return kerr
+	}
+	return this.tokens.Issue(name, tokenTTL)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/flaub/ergo"
+	"github.com/flaub/kissdif"
+	"github.com/flaub/kissdif/driver"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultAddr  = ":7780"
+	registryFile = "databases.json"
+)
+
+// Config holds the settings of a server, as read from a JSON file.
+type Config struct {
+	Addr         string `json:",omitempty"` // address to listen on
+	CertFile     string `json:",omitempty"` // with KeyFile, serves HTTPS
+	KeyFile      string `json:",omitempty"`
+	DataDir      string `json:",omitempty"` // where the databases created are recorded
+	Credentials  string `json:",omitempty"` // credential file of the users allowed in
+	TokenKeyFile string `json:",omitempty"` // key to sign bearer tokens with
+}
+
+func NewConfig() *Config {
+	return &Config{Addr: defaultAddr}
+}
+
+// Load reads the settings in the JSON file at path over this.
+func (this *Config) Load(path string) *ergo.Error {
+	file, err := os.Open(path)
+	if err != nil {
+		return kissdif.Wrap(err)
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(this)
+	if err != nil {
+		return kissdif.NewError(kissdif.EBadParam, "name", "config", "value", err.Error())
+	}
+	return nil
+}
+
+// loadAuth sets up authentication from the credential file and token key
+// named by the config, if any.
+func (this *Server) loadAuth() *ergo.Error {
+	if this.config.Credentials == "" {
+		if this.config.TokenKeyFile != "" {
+			return kissdif.NewError(kissdif.EBadParam, "name", "Credentials", "value", "")
+		}
+		return nil
+	}
+	users, kerr := LoadCredentials(this.config.Credentials)
+	if kerr != nil {
+		return kerr
+	}
+	auths := []Authenticator{&BasicAuth{Users: users}}
+	if this.config.TokenKeyFile != "" {
+		tokens, kerr := LoadTokenKey(this.config.TokenKeyFile)
+		if kerr != nil {
+			return kerr
+		}
+		auths = append(auths, tokens)
+	}
+	this.SetAuth(users, auths...)
+	return nil
+}
+
+// registryEntry is how a database is recorded in the data directory.
+type registryEntry struct {
+	kissdif.DatabaseCfg
+	Schemas map[string]interface{} `json:",omitempty"` // by table
+}
+
+// loadDbs configures the databases recorded in the data directory. If one
+// of them fails, those already configured are closed again.
+func (this *Server) loadDbs() *ergo.Error {
+	kerr := this.configureDbs()
+	if kerr != nil {
+		for name, db := range this.dbs {
+			db.Close()
+			delete(this.dbs, name)
+			delete(this.schemas, name)
+		}
+	}
+	return kerr
+}
+
+func (this *Server) configureDbs() *ergo.Error {
+	file, err := os.Open(filepath.Join(this.config.DataDir, registryFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return kissdif.Wrap(err)
+	}
+	defer file.Close()
+	var entries []registryEntry
+	err = json.NewDecoder(file).Decode(&entries)
+	if err != nil {
+		return kissdif.Wrap(err)
+	}
+	for _, entry := range entries {
+		dbcfg := entry.DatabaseCfg
+		drv, kerr := driver.Open(dbcfg.Driver)
+		if kerr != nil {
+			return kerr
+		}
+		if _, ok := this.dbs[dbcfg.Name]; ok {
+			return kissdif.NewError(kissdif.EConflict, "name", dbcfg.Name)
+		}
+		if other := this.findLocation(drv, &dbcfg); other != "" {
+			return kissdif.NewError(kissdif.EConflict, "name", other)
+		}
+		db, kerr := drv.Configure(dbcfg.Name, dbcfg.Config)
+		if kerr != nil {
+			return kerr
+		}
+		this.dbs[dbcfg.Name] = db
+		for table, doc := range entry.Schemas {
+			schema, kerr := NewSchema(doc)
+			if kerr != nil {
+				return kerr
+			}
+			this.setSchema(dbcfg.Name, table, schema)
+		}
+	}
+	return nil
+}
+
+// saveDbs records the current databases and their schemas in the data
+// directory, if there is one. The caller must hold the lock on them.
+func (this *Server) saveDbs() *ergo.Error {
+	if this.config.DataDir == "" {
+		return nil
+	}
+	err := os.MkdirAll(this.config.DataDir, 0755)
+	if err != nil {
+		return kissdif.Wrap(err)
+	}
+	path := filepath.Join(this.config.DataDir, registryFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return kissdif.Wrap(err)
+	}
+	var entries []registryEntry
+	for _, dbcfg := range this.dbConfigs() {
+		entry := registryEntry{DatabaseCfg: dbcfg}
+		for table, schema := range this.schemas[dbcfg.Name] {
+			if entry.Schemas == nil {
+				entry.Schemas = make(map[string]interface{})
+			}
+			entry.Schemas[table] = schema.doc
+		}
+		entries = append(entries, entry)
+	}
+	err = json.NewEncoder(file).Encode(entries)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return kissdif.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flaub/ergo"
+	"github.com/flaub/kissdif"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema checks documents against a subset of JSON Schema: type, enum,
+// const, properties, required, additionalProperties, items, minimum,
+// maximum, minLength, maxLength, pattern, minItems and maxItems. Other
+// keywords are ignored.
+type Schema struct {
+	doc          interface{} // as given, to be handed back
+	types        []string
+	enum         []interface{}
+	properties   map[string]*Schema
+	required     []string
+	additional   *Schema // checks the properties not listed, if set
+	noAdditional bool
+	items        *Schema
+	minimum      *float64
+	maximum      *float64
+	minLength    int // -1 when not set, like the other limits
+	maxLength    int
+	minItems     int
+	maxItems     int
+	pattern      *regexp.Regexp
+}
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// NewSchema compiles a schema from its decoded JSON or msgpack document.
+func NewSchema(doc interface{}) (*Schema, *ergo.Error) {
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, badSchema("schema", doc)
+	}
+	this := &Schema{
+		doc:       doc,
+		minLength: -1,
+		maxLength: -1,
+		minItems:  -1,
+		maxItems:  -1,
+	}
+	var kerr *ergo.Error
+	if raw, ok := obj["type"]; ok {
+		this.types, kerr = schemaStrings("type", raw)
+		if kerr != nil {
+			return nil, kerr
+		}
+		for _, name := range this.types {
+			if !schemaTypes[name] {
+				return nil, badSchema("type", name)
+			}
+		}
+	}
+	if raw, ok := obj["enum"]; ok {
+		this.enum, ok = raw.([]interface{})
+		if !ok {
+			return nil, badSchema("enum", raw)
+		}
+	}
+	if raw, ok := obj["const"]; ok {
+		this.enum = []interface{}{raw}
+	}
+	if raw, ok := obj["properties"]; ok {
+		props, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, badSchema("properties", raw)
+		}
+		this.properties = make(map[string]*Schema)
+		for name, prop := range props {
+			this.properties[name], kerr = NewSchema(prop)
+			if kerr != nil {
+				return nil, kerr
+			}
+		}
+	}
+	if raw, ok := obj["required"]; ok {
+		this.required, kerr = schemaStrings("required", raw)
+		if kerr != nil {
+			return nil, kerr
+		}
+	}
+	if raw, ok := obj["additionalProperties"]; ok {
+		if allowed, ok := raw.(bool); ok {
+			this.noAdditional = !allowed
+		} else {
+			this.additional, kerr = NewSchema(raw)
+			if kerr != nil {
+				return nil, kerr
+			}
+		}
+	}
+	if raw, ok := obj["items"]; ok {
+		this.items, kerr = NewSchema(raw)
+		if kerr != nil {
+			return nil, kerr
+		}
+	}
+	for name, limit := range map[string]**float64{"minimum": &this.minimum, "maximum": &this.maximum} {
+		if raw, ok := obj[name]; ok {
+			value, ok := toNumber(raw)
+			if !ok {
+				return nil, badSchema(name, raw)
+			}
+			*limit = &value
+		}
+	}
+	for name, limit := range map[string]*int{
+		"minLength": &this.minLength,
+		"maxLength": &this.maxLength,
+		"minItems":  &this.minItems,
+		"maxItems":  &this.maxItems,
+	} {
+		if raw, ok := obj[name]; ok {
+			value, ok := toNumber(raw)
+			if !ok || value < 0 || value != math.Trunc(value) {
+				return nil, badSchema(name, raw)
+			}
+			*limit = int(value)
+		}
+	}
+	if raw, ok := obj["pattern"]; ok {
+		expr, ok := raw.(string)
+		if !ok {
+			return nil, badSchema("pattern", raw)
+		}
+		var err error
+		this.pattern, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, badSchema("pattern", expr)
+		}
+	}
+	return this, nil
+}
+
+func badSchema(keyword string, value interface{}) *ergo.Error {
+	return kissdif.NewError(kissdif.EBadParam, "name", "schema "+keyword, "value", fmt.Sprint(value))
+}
+
+// schemaStrings reads a keyword that is a string or a list of them.
+func schemaStrings(keyword string, raw interface{}) ([]string, *ergo.Error) {
+	if str, ok := raw.(string); ok {
+		return []string{str}, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, badSchema(keyword, raw)
+	}
+	result := make([]string, len(list))
+	for i, item := range list {
+		result[i], ok = item.(string)
+		if !ok {
+			return nil, badSchema(keyword, raw)
+		}
+	}
+	return result, nil
+}
+
+// Validate returns what is wrong with the document, each failure prefixed
+// by the JSON pointer to the value at fault.
+func (this *Schema) Validate(doc interface{}) []string {
+	var failures []string
+	this.validate("", doc, &failures)
+	return failures
+}
+
+func (this *Schema) validate(path string, value interface{}, failures *[]string) {
+	fail := func(format string, args ...interface{}) {
+		at := path
+		if at == "" {
+			at = "/"
+		}
+		*failures = append(*failures, at+": "+fmt.Sprintf(format, args...))
+	}
+	if this.types != nil && !this.hasType(value) {
+		fail("expected %s", strings.Join(this.types, " or "))
+		return
+	}
+	if this.enum != nil {
+		found := false
+		for _, item := range this.enum {
+			if sameValue(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("not one of the allowed values")
+		}
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, name := range this.required {
+			if _, ok := value[name]; !ok {
+				fail("missing property %q", name)
+			}
+		}
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "/" + escapePointer(name)
+			if prop, ok := this.properties[name]; ok {
+				prop.validate(child, value[name], failures)
+			} else if this.noAdditional {
+				fail("unexpected property %q", name)
+			} else if this.additional != nil {
+				this.additional.validate(child, value[name], failures)
+			}
+		}
+	case []interface{}:
+		if this.minItems >= 0 && len(value) < this.minItems {
+			fail("fewer than %d items", this.minItems)
+		}
+		if this.maxItems >= 0 && len(value) > this.maxItems {
+			fail("more than %d items", this.maxItems)
+		}
+		if this.items != nil {
+			for i, item := range value {
+				this.items.validate(fmt.Sprintf("%s/%d", path, i), item, failures)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if this.minLength >= 0 && length < this.minLength {
+			fail("shorter than %d characters", this.minLength)
+		}
+		if this.maxLength >= 0 && length > this.maxLength {
+			fail("longer than %d characters", this.maxLength)
+		}
+		if this.pattern != nil && !this.pattern.MatchString(value) {
+			fail("does not match %q", this.pattern.String())
+		}
+	default:
+		number, ok := toNumber(value)
+		if !ok {
+			break
+		}
+		if this.minimum != nil && number < *this.minimum {
+			fail("less than %v", *this.minimum)
+		}
+		if this.maximum != nil && number > *this.maximum {
+			fail("greater than %v", *this.maximum)
+		}
+	}
+}
+
+func (this *Schema) hasType(value interface{}) bool {
+	for _, name := range this.types {
+		switch name {
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		case "number":
+			if _, ok := toNumber(value); ok {
+				return true
+			}
+		case "integer":
+			if number, ok := toNumber(value); ok && number == math.Trunc(number) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toNumber converts the numbers decoded from either JSON or msgpack.
+func toNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int8:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint:
+		return float64(value), true
+	case uint8:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case json.Number:
+		number, err := value.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// sameValue compares decoded values, taking numbers of any type as equal
+// when their values are.
+func sameValue(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !sameValue(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !sameValue(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case string, bool, nil:
+		return a == b
+	}
+	return false
+}
+
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+// check returns what is wrong with a record that is to be put, if there is
+// a schema.
+func (this *Schema) check(record *kissdif.Record) []string {
+	if this == nil || record.Deleted {
+		return nil
+	}
+	return this.Validate(record.Doc)
+}
+
+// findSchema returns the schema of the table named by the request, or nil
+// if it has none.
+func (this *Server) findSchema(req *Request) (*Schema, *ergo.Error) {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return nil, kerr
+	}
+	tableName, kerr := this.getVar(req, "table")
+	if kerr != nil {
+		return nil, kerr
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.schemas[dbName][tableName], nil
+}
+
+// setSchema sets, or when nil removes, the schema of a table. The caller
+// must hold the lock on the databases.
+func (this *Server) setSchema(db, table string, schema *Schema) {
+	tables, ok := this.schemas[db]
+	if schema == nil {
+		delete(tables, table)
+		if len(tables) == 0 {
+			delete(this.schemas, db)
+		}
+		return
+	}
+	if !ok {
+		tables = make(map[string]*Schema)
+		this.schemas[db] = tables
+	}
+	tables[table] = schema
+}
+
+// updateSchema sets or removes the schema of a table and records the change.
+func (this *Server) updateSchema(db, table string, schema *Schema) *ergo.Error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	prev := this.schemas[db][table]
+	this.setSchema(db, table, schema)
+	kerr := this.saveDbs()
+	if kerr != nil {
+		this.setSchema(db, table, prev)
+		return kerr
+	}
+	return nil
+}
+
+func (this *Server) getSchema(resp *ResponseWriter, req *Request) interface{} {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.authorize(req, dbName, RoleReader)
+	if kerr != nil {
+		return kerr
+	}
+	_, kerr = this.findDb(dbName)
+	if kerr != nil {
+		return kerr
+	}
+	schema, kerr := this.findSchema(req)
+	if kerr != nil {
+		return kerr
+	}
+	if schema == nil {
+		return kissdif.NewError(kissdif.ENotFound)
+	}
+	return schema.doc
+}
+
+func (this *Server) putSchema(resp *ResponseWriter, req *Request) interface{} {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.authorize(req, dbName, RoleAdmin)
+	if kerr != nil {
+		return kerr
+	}
+	_, kerr = this.findDb(dbName)
+	if kerr != nil {
+		return kerr
+	}
+	tableName, kerr := this.getVar(req, "table")
+	if kerr != nil {
+		return kerr
+	}
+	var doc interface{}
+	err := req.DecodePayload(&doc)
+	if err != nil {
+		return kissdif.NewError(kissdif.EBadRequest, "err", err.Error())
+	}
+	schema, kerr := NewSchema(doc)
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.updateSchema(dbName, tableName, schema)
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
+func (this *Server) deleteSchema(resp *ResponseWriter, req *Request) interface{} {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.authorize(req, dbName, RoleAdmin)
+	if kerr != nil {
+		return kerr
+	}
+	tableName, kerr := this.getVar(req, "table")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.updateSchema(dbName, tableName, nil)
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
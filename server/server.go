@@ -1,6 +1,9 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/ant0ine/go-json-rest"
@@ -12,19 +15,82 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	MsgpackHandle = &codec.MsgpackHandle{}
+	MsgpackHandle = newMsgpackHandle()
 )
 
+// newMsgpackHandle decodes documents into the same types as encoding/json,
+// so that drivers can store them as JSON.
+func newMsgpackHandle() *codec.MsgpackHandle {
+	handle := &codec.MsgpackHandle{}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	handle.RawToString = true
+	return handle
+}
+
+// defaultTimeout bounds a long-poll for changes when the client gives no
+// timeout of its own.
+const defaultTimeout = 60 * time.Second
+
+// txTimeout is how long a transaction may sit idle before it is rolled
+// back.
+var txTimeout = 60 * time.Second
+
 type Server struct {
 	http.Server
-	dbs   map[string]driver.Database
-	mutex sync.RWMutex
+	config  *Config
+	dbs     map[string]driver.Database
+	mutex   sync.RWMutex
+	txs     map[string]*serverTx
+	txMutex sync.Mutex
+	users   Credentials
+	auths   []Authenticator
+	tokens  *TokenAuth                    // issues tokens, if they are accepted
+	schemas map[string]map[string]*Schema // by database, then table
+}
+
+// serverTx is a transaction begun through the server, which is rolled back
+// once its timer fires. Only the user who began it may use it.
+type serverTx struct {
+	driver.Tx
+	db    string
+	user  string
+	timer *time.Timer
+}
+
+// store is the part of a table used by the document handlers, either
+// directly or within a transaction.
+type store interface {
+	Get(ctx context.Context, query *kissdif.Query) (chan (*kissdif.Record), *ergo.Error)
+	Put(record *kissdif.Record) (string, *ergo.Error)
+	Delete(id, rev string) (string, *ergo.Error)
+}
+
+// txStore is a table as seen from within a transaction.
+type txStore struct {
+	tx    driver.Tx
+	table string
+}
+
+func (this *txStore) Get(ctx context.Context, query *kissdif.Query) (chan (*kissdif.Record), *ergo.Error) {
+	return this.tx.Get(ctx, this.table, query)
+}
+
+func (this *txStore) Put(record *kissdif.Record) (string, *ergo.Error) {
+	return this.tx.Put(this.table, record)
+}
+
+func (this *txStore) Delete(id, rev string) (string, *ergo.Error) {
+	return this.tx.Delete(this.table, id, rev)
 }
 
 type Decoder interface {
@@ -33,7 +99,8 @@ type Decoder interface {
 
 type Request struct {
 	*rest.Request
-	dec Decoder
+	dec       Decoder
+	mediatype string
 }
 
 func (this *Request) DecodePayload(v interface{}) error {
@@ -80,6 +147,19 @@ func (this *ResponseWriter) Error(err *ergo.Error) {
 		code = http.StatusBadRequest
 	case kissdif.ENotFound:
 		code = http.StatusNotFound
+	case kissdif.EBadTx:
+		code = http.StatusNotFound
+	case kissdif.EUnauthorized:
+		code = http.StatusUnauthorized
+		this.Header().Set("WWW-Authenticate", `Basic realm="kissdif"`)
+	case kissdif.EForbidden:
+		code = http.StatusForbidden
+	case kissdif.EInvalid:
+		code = http.StatusUnprocessableEntity
+	case kissdif.EPrecondition:
+		code = http.StatusPreconditionFailed
+	case kissdif.ESerialTx:
+		code = http.StatusNotImplemented
 	default:
 		log.Panicf("Forgot to check for error code: %d", err.Code)
 	}
@@ -93,6 +173,10 @@ type HandlerFunc func(*ResponseWriter, *Request) interface{}
 func typeWrapper(fn HandlerFunc) RestHandlerFunc {
 	return func(resp *rest.ResponseWriter, req *rest.Request) {
 		ctype := req.Header.Get("Content-Type")
+		if ctype == "" {
+			// e.g. a browser's EventSource
+			ctype = "application/json"
+		}
 		mediatype, params, _ := mime.ParseMediaType(ctype)
 		charset, ok := params["charset"]
 		if !ok {
@@ -115,7 +199,7 @@ func typeWrapper(fn HandlerFunc) RestHandlerFunc {
 			http.Error(resp, msg, http.StatusUnsupportedMediaType)
 		}
 		writer := &ResponseWriter{ResponseWriter: resp, enc: enc}
-		reader := &Request{Request: req, dec: dec}
+		reader := &Request{Request: req, dec: dec, mediatype: mediatype}
 		ret := fn(writer, reader)
 		writer.Header().Set("Content-Type", ctype)
 		if err, ok := ret.(*ergo.Error); ok {
@@ -127,20 +211,60 @@ func typeWrapper(fn HandlerFunc) RestHandlerFunc {
 }
 
 func NewServer() *Server {
+	return newServer(NewConfig())
+}
+
+// Open returns a server with the given config, on which the databases
+// recorded in its data directory are configured again.
+func Open(config *Config) (*Server, *ergo.Error) {
+	this := newServer(config)
+	kerr := this.loadAuth()
+	if kerr != nil {
+		return nil, kerr
+	}
+	if config.DataDir != "" {
+		kerr := this.loadDbs()
+		if kerr != nil {
+			return nil, kerr
+		}
+	}
+	return this, nil
+}
+
+func newServer(config *Config) *Server {
 	handler := &rest.ResourceHandler{
 		EnableRelaxedContentType: true,
 	}
 
 	this := &Server{
 		Server: http.Server{
-			Addr:    ":7780",
+			Addr:    config.Addr,
 			Handler: handler,
 		},
-		dbs: make(map[string]driver.Database),
+		config:  config,
+		dbs:     make(map[string]driver.Database),
+		txs:     make(map[string]*serverTx),
+		schemas: make(map[string]map[string]*Schema),
 	}
 
 	handler.SetRoutes(
+		rest.Route{"GET", "/", typeWrapper(this.listDbs)},
+		rest.Route{"POST", "/_token", typeWrapper(this.postToken)},
+		rest.Route{"GET", "/:db", typeWrapper(this.listTables)},
+		rest.Route{"GET", "/:db/:table", typeWrapper(this.listIndexes)},
 		rest.Route{"PUT", "/:db", typeWrapper(this.putDb)},
+		rest.Route{"DELETE", "/:db", typeWrapper(this.dropDb)},
+		rest.Route{"DELETE", "/:db/:table", typeWrapper(this.dropTable)},
+		rest.Route{"GET", "/:db/:table/_changes", typeWrapper(this.getChanges)},
+		rest.Route{"GET", "/:db/:table/_schema", typeWrapper(this.getSchema)},
+		rest.Route{"GET", "/:db/:table/_index", typeWrapper(this.listIndexDefs)},
+		rest.Route{"PUT", "/:db/:table/_index/:name", typeWrapper(this.putIndexDef)},
+		rest.Route{"PUT", "/:db/:table/_schema", typeWrapper(this.putSchema)},
+		rest.Route{"DELETE", "/:db/:table/_schema", typeWrapper(this.deleteSchema)},
+		rest.Route{"POST", "/:db/:table/_bulk", typeWrapper(this.postBulk)},
+		rest.Route{"POST", "/:db/_tx", typeWrapper(this.beginTx)},
+		rest.Route{"POST", "/:db/_tx/:tx", typeWrapper(this.commitTx)},
+		rest.Route{"DELETE", "/:db/_tx/:tx", typeWrapper(this.rollbackTx)},
 		rest.Route{"GET", "/:db/:table/:index", typeWrapper(this.doQuery)},
 		rest.Route{"GET", "/:db/:table/:index/*key", typeWrapper(this.getRecord)},
 		rest.Route{"PUT", "/:db/:table/_id/*key", typeWrapper(this.putRecord)},
@@ -150,6 +274,15 @@ func NewServer() *Server {
 	return this
 }
 
+// ListenAndServe serves HTTPS when the config names a certificate and key,
+// and HTTP otherwise.
+func (this *Server) ListenAndServe() error {
+	if this.config.CertFile != "" || this.config.KeyFile != "" {
+		return this.Server.ListenAndServeTLS(this.config.CertFile, this.config.KeyFile)
+	}
+	return this.Server.ListenAndServe()
+}
+
 func (this *Server) findDb(name string) (driver.Database, *ergo.Error) {
 	this.mutex.RLock()
 	defer this.mutex.RUnlock()
@@ -172,11 +305,17 @@ func (this *Server) getVar(req *Request, name string) (string, *ergo.Error) {
 	return value, nil
 }
 
-func (this *Server) getTable(req *Request, create bool) (driver.Table, *ergo.Error) {
+// getTable returns the table named by the request, once the user making it
+// is found to have at least the role on its database.
+func (this *Server) getTable(req *Request, role Role, create bool) (driver.Table, *ergo.Error) {
 	dbName, kerr := this.getVar(req, "db")
 	if kerr != nil {
 		return nil, kerr
 	}
+	kerr = this.authorize(req, dbName, role)
+	if kerr != nil {
+		return nil, kerr
+	}
 	db, kerr := this.findDb(dbName)
 	if kerr != nil {
 		return nil, kerr
@@ -188,12 +327,262 @@ func (this *Server) getTable(req *Request, create bool) (driver.Table, *ergo.Err
 	return db.GetTable(tableName, create)
 }
 
+// getStore returns the table named by the request, within the
+// transaction named by the tx parameter if there is one.
+func (this *Server) getStore(req *Request, role Role, create bool) (store, *ergo.Error) {
+	id := req.URL.Query().Get("tx")
+	if id == "" {
+		return this.getTable(req, role, create)
+	}
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return nil, kerr
+	}
+	user, kerr := this.authorizeUser(req, dbName, role)
+	if kerr != nil {
+		return nil, kerr
+	}
+	tableName, kerr := this.getVar(req, "table")
+	if kerr != nil {
+		return nil, kerr
+	}
+	tx, kerr := this.findTx(dbName, id, user)
+	if kerr != nil {
+		return nil, kerr
+	}
+	return &txStore{tx: tx, table: tableName}, nil
+}
+
+// findTx returns a transaction the user began on the named database and
+// restarts its timer.
+func (this *Server) findTx(dbName, id, user string) (driver.Tx, *ergo.Error) {
+	this.txMutex.Lock()
+	defer this.txMutex.Unlock()
+	tx, ok := this.txs[id]
+	if !ok || tx.db != dbName || tx.user != user {
+		return nil, kissdif.NewError(kissdif.EBadTx, "name", id)
+	}
+	tx.timer.Reset(txTimeout)
+	return tx, nil
+}
+
+// takeTx removes a transaction the user began on the named database so
+// that it can be finished.
+func (this *Server) takeTx(dbName, id, user string) (driver.Tx, *ergo.Error) {
+	this.txMutex.Lock()
+	defer this.txMutex.Unlock()
+	tx, ok := this.txs[id]
+	if !ok || tx.db != dbName || tx.user != user {
+		return nil, kissdif.NewError(kissdif.EBadTx, "name", id)
+	}
+	tx.timer.Stop()
+	delete(this.txs, id)
+	return tx, nil
+}
+
+func (this *Server) expireTx(id string) {
+	this.txMutex.Lock()
+	tx, ok := this.txs[id]
+	delete(this.txs, id)
+	this.txMutex.Unlock()
+	if ok {
+		tx.Rollback()
+	}
+}
+
+func (this *Server) beginTx(resp *ResponseWriter, req *Request) interface{} {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	user, kerr := this.authorizeUser(req, dbName, RoleWriter)
+	if kerr != nil {
+		return kerr
+	}
+	db, kerr := this.findDb(dbName)
+	if kerr != nil {
+		return kerr
+	}
+	// the transaction would hold up every other request until it finished
+	serial, ok := db.(driver.Serial)
+	if ok && serial.Serial() {
+		return kissdif.NewError(kissdif.ESerialTx, "name", dbName)
+	}
+	var raw [16]byte
+	_, err := rand.Read(raw[:])
+	if err != nil {
+		return kissdif.Wrap(err)
+	}
+	id := hex.EncodeToString(raw[:])
+	tx, kerr := db.Begin()
+	if kerr != nil {
+		return kerr
+	}
+	this.txMutex.Lock()
+	defer this.txMutex.Unlock()
+	this.txs[id] = &serverTx{
+		Tx:    tx,
+		db:    dbName,
+		user:  user,
+		timer: time.AfterFunc(txTimeout, func() { this.expireTx(id) }),
+	}
+	return id
+}
+
+func (this *Server) commitTx(resp *ResponseWriter, req *Request) interface{} {
+	return this.finishTx(req, driver.Tx.Commit)
+}
+
+func (this *Server) rollbackTx(resp *ResponseWriter, req *Request) interface{} {
+	return this.finishTx(req, driver.Tx.Rollback)
+}
+
+func (this *Server) finishTx(req *Request, finish func(driver.Tx) *ergo.Error) interface{} {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	user, kerr := this.authorizeUser(req, dbName, RoleWriter)
+	if kerr != nil {
+		return kerr
+	}
+	id, kerr := this.getVar(req, "tx")
+	if kerr != nil {
+		return kerr
+	}
+	tx, kerr := this.takeTx(dbName, id, user)
+	if kerr != nil {
+		return kerr
+	}
+	kerr = finish(tx)
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
+func (this *Server) listDbs(resp *ResponseWriter, req *Request) interface{} {
+	if this.users == nil {
+		this.mutex.RLock()
+		defer this.mutex.RUnlock()
+		return this.dbConfigs()
+	}
+	// authenticating may be slow, so it is done before taking the lock
+	name, kerr := this.authenticate(req)
+	if kerr != nil {
+		return kerr
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	// only the databases the user may read are listed
+	result := []kissdif.DatabaseCfg{}
+	for _, dbcfg := range this.dbConfigs() {
+		if this.users.Role(name, dbcfg.Name) >= RoleReader {
+			result = append(result, dbcfg)
+		}
+	}
+	return result
+}
+
+// dbConfigs returns the configuration of every database, ordered by name.
+// The caller must hold the lock on them.
+func (this *Server) dbConfigs() []kissdif.DatabaseCfg {
+	names := []string{}
+	for name := range this.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []kissdif.DatabaseCfg{}
+	for _, name := range names {
+		db := this.dbs[name]
+		result = append(result, kissdif.DatabaseCfg{
+			Name:   db.Name(),
+			Driver: db.Driver(),
+			Config: db.Config(),
+		})
+	}
+	return result
+}
+
+func (this *Server) listTables(resp *ResponseWriter, req *Request) interface{} {
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.authorize(req, dbName, RoleReader)
+	if kerr != nil {
+		return kerr
+	}
+	db, kerr := this.findDb(dbName)
+	if kerr != nil {
+		return kerr
+	}
+	names, kerr := db.ListTables()
+	if kerr != nil {
+		return kerr
+	}
+	return names
+}
+
+func (this *Server) listIndexes(resp *ResponseWriter, req *Request) interface{} {
+	table, kerr := this.getTable(req, RoleReader, false)
+	if kerr != nil {
+		return kerr
+	}
+	names, kerr := table.ListIndexes()
+	if kerr != nil {
+		return kerr
+	}
+	return names
+}
+
+func (this *Server) listIndexDefs(resp *ResponseWriter, req *Request) interface{} {
+	table, kerr := this.getTable(req, RoleReader, false)
+	if kerr != nil {
+		return kerr
+	}
+	defs, kerr := table.ListIndexDefs()
+	if kerr != nil {
+		return kerr
+	}
+	return defs
+}
+
+func (this *Server) putIndexDef(resp *ResponseWriter, req *Request) interface{} {
+	table, kerr := this.getTable(req, RoleAdmin, true)
+	if kerr != nil {
+		return kerr
+	}
+	name, kerr := this.getVar(req, "name")
+	if kerr != nil {
+		return kerr
+	}
+	var def kissdif.IndexDef
+	err := req.DecodePayload(&def)
+	if err != nil {
+		return kissdif.NewError(kissdif.EBadRequest, "err", err.Error())
+	}
+	if def.Name != "" && def.Name != name {
+		return kissdif.NewError(kissdif.EBadParam, "name", "index", "value", def.Name)
+	}
+	def.Name = name
+	kerr = table.DefineIndex(&def)
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
 func (this *Server) putDb(resp *ResponseWriter, req *Request) interface{} {
 	// log.Printf("PUT db: %v\n", req.URL)
 	dbName, kerr := this.getVar(req, "db")
 	if kerr != nil {
 		return kerr
 	}
+	kerr = this.authorize(req, dbName, RoleAdmin)
+	if kerr != nil {
+		return kerr
+	}
 	var dbcfg kissdif.DatabaseCfg
 	err := req.DecodePayload(&dbcfg)
 	if err != nil {
@@ -203,18 +592,130 @@ func (this *Server) putDb(resp *ResponseWriter, req *Request) interface{} {
 	if kerr != nil {
 		return kerr
 	}
+	// the lock is held while configuring, so that no two databases are
+	// opened over the same files
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.dbs[dbName]; ok {
+		return kissdif.NewError(kissdif.EConflict, "name", dbName)
+	}
+	if other := this.findLocation(drv, &dbcfg); other != "" {
+		return kissdif.NewError(kissdif.EConflict, "name", other)
+	}
 	db, kerr := drv.Configure(dbName, dbcfg.Config)
 	if kerr != nil {
 		return kerr
 	}
+	this.dbs[dbName] = db
+	kerr = this.saveDbs()
+	if kerr != nil {
+		delete(this.dbs, dbName)
+		db.Close()
+		return kerr
+	}
+	return nil
+}
+
+// findLocation returns the name of an open database that keeps its
+// contents in the same files as dbcfg would, or "" if there is none. The
+// caller must hold the lock on the databases.
+func (this *Server) findLocation(drv driver.Driver, dbcfg *kissdif.DatabaseCfg) string {
+	locator, ok := drv.(driver.Locator)
+	if !ok {
+		return ""
+	}
+	path := absPath(locator.Path(dbcfg.Config))
+	if path == "" {
+		return ""
+	}
+	for name, db := range this.dbs {
+		if db.Driver() == dbcfg.Driver && absPath(locator.Path(db.Config())) == path {
+			return name
+		}
+	}
+	return ""
+}
+
+// absPath returns path made absolute, so that paths to the same file
+// compare equal. An empty path stays empty.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+func (this *Server) dropDb(resp *ResponseWriter, req *Request) interface{} {
+	// log.Printf("DELETE db: %v\n", req.URL)
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.authorize(req, dbName, RoleAdmin)
+	if kerr != nil {
+		return kerr
+	}
+	// the lock is held while dropping, so that no database is configured
+	// over the files before they are removed
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
-	this.dbs[dbName] = db
+	db, ok := this.dbs[dbName]
+	if !ok {
+		return kissdif.NewError(kissdif.EBadDatabase, "name", dbName)
+	}
+	schemas := this.schemas[dbName]
+	delete(this.dbs, dbName)
+	delete(this.schemas, dbName)
+	kerr = this.saveDbs()
+	if kerr != nil {
+		this.dbs[dbName] = db
+		if schemas != nil {
+			this.schemas[dbName] = schemas
+		}
+		return kerr
+	}
+	kerr = db.Drop()
+	if kerr != nil {
+		return kerr
+	}
+	return nil
+}
+
+func (this *Server) dropTable(resp *ResponseWriter, req *Request) interface{} {
+	// log.Printf("DELETE table: %v\n", req.URL)
+	dbName, kerr := this.getVar(req, "db")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.authorize(req, dbName, RoleAdmin)
+	if kerr != nil {
+		return kerr
+	}
+	db, kerr := this.findDb(dbName)
+	if kerr != nil {
+		return kerr
+	}
+	tableName, kerr := this.getVar(req, "table")
+	if kerr != nil {
+		return kerr
+	}
+	kerr = db.DropTable(tableName)
+	if kerr != nil {
+		return kerr
+	}
+	kerr = this.updateSchema(dbName, tableName, nil)
+	if kerr != nil {
+		return kerr
+	}
 	return nil
 }
 
 func (this *Server) putRecord(resp *ResponseWriter, req *Request) interface{} {
-	table, kerr := this.getTable(req, true)
+	table, kerr := this.getStore(req, RoleWriter, true)
 	if kerr != nil {
 		return kerr
 	}
@@ -231,17 +732,92 @@ func (this *Server) putRecord(resp *ResponseWriter, req *Request) interface{} {
 	if record.Id != id {
 		return kissdif.NewError(kissdif.EBadParam, "name", "id", "value", id)
 	}
+	ifMatch, kerr := this.getIfMatch(req, table, id)
+	if kerr != nil {
+		return kerr
+	}
+	if ifMatch != "" {
+		if record.Rev != "" && record.Rev != ifMatch {
+			return kissdif.NewError(kissdif.EBadParam, "name", "rev", "value", record.Rev)
+		}
+		record.Rev = ifMatch
+	}
+	schema, kerr := this.findSchema(req)
+	if kerr != nil {
+		return kerr
+	}
+	failures := schema.check(&record)
+	if failures != nil {
+		return kissdif.NewError(kissdif.EInvalid, "errors", failures)
+	}
 	rev, kerr := table.Put(&record)
 	if kerr != nil {
 		return kerr
 	}
+	resp.Header().Set("ETag", strconv.Quote(rev))
 	return rev
 }
 
+func (this *Server) postBulk(resp *ResponseWriter, req *Request) interface{} {
+	table, kerr := this.getTable(req, RoleWriter, true)
+	if kerr != nil {
+		return kerr
+	}
+	var bulk kissdif.Bulk
+	err := req.DecodePayload(&bulk)
+	if err != nil {
+		return kissdif.NewError(kissdif.EBadRequest, "err", err.Error())
+	}
+	for _, record := range bulk.Records {
+		if record == nil || record.Id == "" {
+			return kissdif.NewError(kissdif.EBadParam, "name", "id", "value", "")
+		}
+	}
+	schema, kerr := this.findSchema(req)
+	if kerr != nil {
+		return kerr
+	}
+	// without Partial, one record that doesn't match fails them all
+	rejected := make([]*ergo.Error, len(bulk.Records))
+	valid := []*kissdif.Record{}
+	failures := []string{}
+	for i, record := range bulk.Records {
+		errors := schema.check(record)
+		if errors == nil {
+			valid = append(valid, record)
+			continue
+		}
+		rejected[i] = kissdif.NewError(kissdif.EInvalid, "errors", errors)
+		for _, failure := range errors {
+			failures = append(failures, record.Id+": "+failure)
+		}
+	}
+	if len(failures) > 0 && !bulk.Partial {
+		return kissdif.NewError(kissdif.EInvalid, "errors", failures)
+	}
+	results, kerr := table.PutMany(valid, !bulk.Partial)
+	if kerr != nil {
+		return kerr
+	}
+	if len(valid) == len(bulk.Records) {
+		return results
+	}
+	merged := make([]*kissdif.BulkResult, 0, len(bulk.Records))
+	for i, record := range bulk.Records {
+		if rejected[i] != nil {
+			merged = append(merged, &kissdif.BulkResult{Id: record.Id, Error: rejected[i]})
+		} else {
+			merged = append(merged, results[0])
+			results = results[1:]
+		}
+	}
+	return merged
+}
+
 func (this *Server) doQuery(resp *ResponseWriter, req *Request) interface{} {
 	// fmt.Printf("GET records: %v\n", req.URL)
 	args := req.URL.Query()
-	table, kerr := this.getTable(req, false)
+	table, kerr := this.getStore(req, RoleReader, false)
 	if kerr != nil {
 		return kerr
 	}
@@ -257,8 +833,26 @@ func (this *Server) doQuery(resp *ResponseWriter, req *Request) interface{} {
 	if kerr != nil {
 		return kerr
 	}
+	desc, kerr := getDescending(args)
+	if kerr != nil {
+		return kerr
+	}
+	deleted, kerr := getBool(args, "deleted")
+	if kerr != nil {
+		return kerr
+	}
+	stream, kerr := getBool(args, "stream")
+	if kerr != nil {
+		return kerr
+	}
 	query := kissdif.NewQuery(index, lower, upper, limit)
-	result, kerr := this.processQuery(table, query)
+	query.After = args.Get("cursor")
+	query.Descending = desc
+	query.Deleted = deleted
+	if stream {
+		return this.streamQuery(resp, req, table, query)
+	}
+	result, kerr := this.processQuery(req.Context(), table, query)
 	if kerr != nil {
 		return kerr
 	}
@@ -268,7 +862,7 @@ func (this *Server) doQuery(resp *ResponseWriter, req *Request) interface{} {
 func (this *Server) getRecord(resp *ResponseWriter, req *Request) interface{} {
 	// log.Printf("GET record: %v\n", req.URL)
 	args := req.URL.Query()
-	table, kerr := this.getTable(req, false)
+	table, kerr := this.getStore(req, RoleReader, false)
 	if kerr != nil {
 		return kerr
 	}
@@ -284,20 +878,42 @@ func (this *Server) getRecord(resp *ResponseWriter, req *Request) interface{} {
 	if kerr != nil {
 		return kerr
 	}
+	desc, kerr := getDescending(args)
+	if kerr != nil {
+		return kerr
+	}
+	deleted, kerr := getBool(args, "deleted")
+	if kerr != nil {
+		return kerr
+	}
 	query := kissdif.NewQueryEQ(index, key, limit)
-	result, kerr := this.processQuery(table, query)
+	query.Descending = desc
+	query.Deleted = deleted
+	result, kerr := this.processQuery(req.Context(), table, query)
 	if kerr != nil {
 		return kerr
 	}
 	if len(result.Records) == 0 {
 		return kissdif.NewError(kissdif.ENotFound)
 	}
+	if len(result.Records) == 1 {
+		rev := result.Records[0].Rev
+		resp.Header().Set("ETag", strconv.Quote(rev))
+		ifNoneMatch, kerr := getRevHeader(req, "If-None-Match")
+		if kerr != nil {
+			return kerr
+		}
+		if ifNoneMatch.match(rev, true) {
+			resp.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
 	return result
 }
 
 func (this *Server) deleteRecord(resp *ResponseWriter, req *Request) interface{} {
 	// log.Printf("DELETE record: %v\n", req.URL)
-	table, kerr := this.getTable(req, false)
+	table, kerr := this.getStore(req, RoleWriter, false)
 	if kerr != nil {
 		return kerr
 	}
@@ -305,12 +921,105 @@ func (this *Server) deleteRecord(resp *ResponseWriter, req *Request) interface{}
 	if kerr != nil {
 		return kerr
 	}
-	table.Delete(key)
+	rev, kerr := this.getIfMatch(req, table, key)
+	if kerr != nil {
+		return kerr
+	}
+	if rev == "" {
+		rev = req.URL.Query().Get("rev")
+	}
+	tombRev, kerr := table.Delete(key, rev)
+	if kerr != nil {
+		return kerr
+	}
+	if tombRev != "" {
+		resp.Header().Set("ETag", strconv.Quote(tombRev))
+	}
 	return nil
 }
 
-func (this *Server) processQuery(table driver.Table, query *kissdif.Query) (*kissdif.ResultSet, *ergo.Error) {
-	ch, kerr := table.Get(query)
+func (this *Server) getChanges(resp *ResponseWriter, req *Request) interface{} {
+	args := req.URL.Query()
+	table, kerr := this.getTable(req, RoleReader, false)
+	if kerr != nil {
+		return kerr
+	}
+	if args.Get("since") == "" && req.Header.Get("Last-Event-ID") != "" {
+		args.Set("since", req.Header.Get("Last-Event-ID"))
+	}
+	since, kerr := getSince(args)
+	if kerr != nil {
+		return kerr
+	}
+	timeout, kerr := getTimeout(args)
+	if kerr != nil {
+		return kerr
+	}
+	switch args.Get("feed") {
+	case "", "normal":
+		timeout = 0
+	case "longpoll":
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+	case "eventsource":
+		return this.streamChanges(resp, req, table, since, timeout)
+	default:
+		return kissdif.NewError(kissdif.EBadParam, "name", "feed", "value", args.Get("feed"))
+	}
+	result, kerr := driver.WaitChanges(req.Context(), table, since, timeout)
+	if kerr != nil {
+		return kerr
+	}
+	return result
+}
+
+// streamChanges sends every change after since as a server-sent event,
+// until the client goes away or the timeout, if any, passes.
+func (this *Server) streamChanges(resp *ResponseWriter, req *Request,
+	table driver.Table, since uint64, timeout time.Duration) interface{} {
+	flusher, ok := resp.ResponseWriter.ResponseWriter.(http.Flusher)
+	if !ok {
+		return kissdif.NewError(kissdif.EGeneric, "err", "streaming is not supported")
+	}
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		watch, kerr := table.Watch(since)
+		if kerr != nil {
+			log.Printf("Watch failed: %v", kerr)
+			return nil
+		}
+		ch, kerr := table.Changes(req.Context(), since)
+		if kerr != nil {
+			log.Printf("Changes failed: %v", kerr)
+			return nil
+		}
+		for change := range ch {
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(resp, "id: %d\ndata: %s\n\n", change.Seq, data)
+			since = change.Seq
+		}
+		flusher.Flush()
+		select {
+		case <-watch:
+		case <-timer:
+			return nil
+		case <-req.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (this *Server) processQuery(ctx context.Context, table store, query *kissdif.Query) (*kissdif.ResultSet, *ergo.Error) {
+	ctx, failure := driver.WithFailure(ctx)
+	ch, kerr := table.Get(ctx, query)
 	if kerr != nil {
 		return nil, kerr
 	}
@@ -325,9 +1034,200 @@ func (this *Server) processQuery(table driver.Table, query *kissdif.Query) (*kis
 			result.Records = append(result.Records, record)
 		}
 	}
+	if failure.Err() != nil {
+		return nil, failure.Err()
+	}
+	if result.More && len(result.Records) != 0 {
+		result.Cursor = result.Records[len(result.Records)-1].Cursor
+	}
 	return result, nil
 }
 
+// streamQuery writes each record in its own Chunk as the driver sends it,
+// followed by a Chunk that ends the result, or one holding the error that
+// ended it early. JSON chunks are sent one per line as NDJSON. Whatever has
+// been written is flushed whenever the next record isn't ready yet, such as
+// while the driver reads its next page. The query is cancelled if the
+// client goes away.
+func (this *Server) streamQuery(resp *ResponseWriter, req *Request,
+	table store, query *kissdif.Query) interface{} {
+	flusher, ok := resp.ResponseWriter.ResponseWriter.(http.Flusher)
+	if !ok {
+		return kissdif.NewError(kissdif.EGeneric, "err", "streaming is not supported")
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	ctx, failure := driver.WithFailure(ctx)
+	ch, kerr := table.Get(ctx, query)
+	if kerr != nil {
+		return kerr
+	}
+	ctype := req.mediatype
+	if ctype == "application/json" {
+		ctype = "application/x-ndjson"
+	}
+	resp.Header().Set("Content-Type", ctype)
+	resp.WriteHeader(http.StatusOK)
+	last := kissdif.Chunk{More: true}
+	for {
+		var record *kissdif.Record
+		select {
+		case record, ok = <-ch:
+		default:
+			flusher.Flush()
+			record, ok = <-ch
+		}
+		if !ok {
+			break
+		}
+		if record == nil {
+			last.More = false
+			continue
+		}
+		last.Cursor = record.Cursor
+		err := resp.WriteData(&kissdif.Chunk{Record: record})
+		if err != nil {
+			log.Printf("Streaming query failed: %v", err)
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if failure.Err() != nil {
+		resp.WriteData(&kissdif.Chunk{Error: failure.Err()})
+		return nil
+	}
+	if !last.More {
+		last.Cursor = ""
+	}
+	resp.WriteData(&last)
+	return nil
+}
+
+// revTag is one entity tag of a conditional request header.
+type revTag struct {
+	rev  string
+	weak bool
+}
+
+// revTags are the entity tags carried by a conditional request header such
+// as If-Match. A nil revTags means the header is absent.
+type revTags struct {
+	any  bool
+	tags []revTag
+}
+
+// match reports whether rev, the current revision of a record, matches
+// one of the tags. Weak tags only match under weak comparison.
+func (this *revTags) match(rev string, weak bool) bool {
+	if this == nil {
+		return false
+	}
+	if this.any {
+		return true
+	}
+	for _, tag := range this.tags {
+		if tag.rev == rev && (weak || !tag.weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRevHeader parses a conditional request header, which holds either
+// `*` or a comma separated list of double quoted revisions, each of which
+// may be marked weak with a `W/` prefix.
+func getRevHeader(req *Request, name string) (*revTags, *ergo.Error) {
+	value := strings.Join(req.Header[http.CanonicalHeaderKey(name)], ",")
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	bad := kissdif.NewError(kissdif.EBadParam, "name", name, "value", value)
+	if strings.TrimSpace(value) == "*" {
+		return &revTags{any: true}, nil
+	}
+	result := &revTags{}
+	rest := value
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if rest[0] == ',' {
+			rest = rest[1:]
+			continue
+		}
+		var tag revTag
+		if strings.HasPrefix(rest, "W/") {
+			tag.weak = true
+			rest = rest[2:]
+		}
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, bad
+		}
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return nil, bad
+		}
+		tag.rev = rest[1 : end+1]
+		result.tags = append(result.tags, tag)
+		rest = strings.TrimLeft(rest[end+2:], " \t")
+		if rest != "" && rest[0] != ',' {
+			return nil, bad
+		}
+	}
+	if len(result.tags) == 0 {
+		return nil, bad
+	}
+	return result, nil
+}
+
+// getIfMatch returns the revision that a write to the record id must
+// replace, as required by the If-Match header, or "" if it is absent.
+// If-Match: * fails with EPrecondition when the record doesn't exist. A
+// list of tags fails with EConflict when none of them is the revision of
+// a stored record; when the record is missing or deleted the first strong
+// tag is returned instead, leaving it to the driver to refuse it, just as
+// it would without the header. The driver checks the returned revision
+// again as it writes.
+func (this *Server) getIfMatch(req *Request, table store, id string) (string, *ergo.Error) {
+	ifMatch, kerr := getRevHeader(req, "If-Match")
+	if kerr != nil {
+		return "", kerr
+	}
+	if ifMatch == nil {
+		return "", nil
+	}
+	query := kissdif.NewQueryEQ("_id", id, 1)
+	query.Deleted = true
+	result, kerr := this.processQuery(req.Context(), table, query)
+	if kerr != nil {
+		return "", kerr
+	}
+	var cur *kissdif.Record
+	if len(result.Records) != 0 {
+		cur = result.Records[0]
+	}
+	if cur != nil && ifMatch.match(cur.Rev, false) {
+		if cur.Deleted && ifMatch.any {
+			return "", kissdif.NewError(kissdif.EPrecondition, "name", "If-Match")
+		}
+		return cur.Rev, nil
+	}
+	if ifMatch.any {
+		return "", kissdif.NewError(kissdif.EPrecondition, "name", "If-Match")
+	}
+	if cur == nil || cur.Deleted {
+		for _, tag := range ifMatch.tags {
+			if !tag.weak {
+				return tag.rev, nil
+			}
+		}
+	}
+	return "", kissdif.NewError(kissdif.EConflict, "id", id)
+}
+
 func getLimit(args url.Values) (uint, *ergo.Error) {
 	var limit uint64 = 1000
 	strLimit := args.Get("limit")
@@ -341,6 +1241,46 @@ func getLimit(args url.Values) (uint, *ergo.Error) {
 	return uint(limit), nil
 }
 
+func getTimeout(args url.Values) (time.Duration, *ergo.Error) {
+	strTimeout := args.Get("timeout")
+	if strTimeout == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseUint(strTimeout, 10, 32)
+	if err != nil {
+		return 0, kissdif.NewError(kissdif.EBadParam, "name", "timeout", "value", strTimeout)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func getSince(args url.Values) (uint64, *ergo.Error) {
+	strSince := args.Get("since")
+	if strSince == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseUint(strSince, 10, 64)
+	if err != nil {
+		return 0, kissdif.NewError(kissdif.EBadParam, "name", "since", "value", strSince)
+	}
+	return since, nil
+}
+
+func getDescending(args url.Values) (bool, *ergo.Error) {
+	return getBool(args, "desc")
+}
+
+func getBool(args url.Values, name string) (bool, *ergo.Error) {
+	str := args.Get(name)
+	if str == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, kissdif.NewError(kissdif.EBadParam, "name", name, "value", str)
+	}
+	return value, nil
+}
+
 func getBounds(args url.Values) (lower, upper kissdif.Bound, err *ergo.Error) {
 	for k, v := range args {
 		switch k {
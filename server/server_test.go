@@ -1,11 +1,24 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest"
+	"github.com/flaub/ergo"
+	"github.com/flaub/kissdif"
+	"github.com/flaub/kissdif/driver"
+	_ "github.com/flaub/kissdif/driver/mem"
+	_ "github.com/flaub/kissdif/driver/sql"
 	. "github.com/motain/gocheck"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -35,3 +48,673 @@ func (this *MainSuite) TestServer(c *C) {
 
 	c.Logf("Result: %s", result)
 }
+
+func (this *MainSuite) do(c *C, method, url, body string, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res
+}
+
+func (this *MainSuite) TestConditional(c *C) {
+	ts := httptest.NewServer(NewServer().Server.Handler)
+	defer ts.Close()
+
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	url := ts.URL + "/db/table/_id/1"
+	res = this.do(c, "PUT", url, `{"Id": "1", "Doc": "a"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, Matches, `^".+"$`)
+
+	res = this.do(c, "GET", url, "", nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), Equals, etag)
+
+	res = this.do(c, "GET", url, "", http.Header{"If-None-Match": {etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusNotModified)
+
+	res = this.do(c, "GET", url, "", http.Header{"If-None-Match": {"bogus"}})
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+
+	res = this.do(c, "GET", url, "", http.Header{"If-None-Match": {`"xxx", W/` + etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusNotModified)
+
+	res = this.do(c, "GET", url, "", http.Header{"If-None-Match": {"*"}})
+	c.Assert(res.StatusCode, Equals, http.StatusNotModified)
+
+	res = this.do(c, "GET", ts.URL+"/db/table/_id/2", "", http.Header{"If-None-Match": {"*"}})
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+
+	res = this.do(c, "PUT", url, `{"Id": "1", "Doc": "b"}`, http.Header{"If-Match": {"W/" + etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/2", `{"Id": "2", "Doc": "b"}`, http.Header{"If-Match": {"*"}})
+	c.Assert(res.StatusCode, Equals, http.StatusPreconditionFailed)
+
+	res = this.do(c, "DELETE", ts.URL+"/db/table/_id/2", "", http.Header{"If-Match": {"*"}})
+	c.Assert(res.StatusCode, Equals, http.StatusPreconditionFailed)
+
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/2", `{"Id": "2", "Doc": "b"}`, http.Header{"If-Match": {etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+
+	res = this.do(c, "DELETE", ts.URL+"/db/table/_id/2", "", http.Header{"If-Match": {etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	res = this.do(c, "PUT", url, `{"Id": "1", "Doc": "a"}`, http.Header{"If-Match": {`"xxx", ` + etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	etag = res.Header.Get("ETag")
+
+	res = this.do(c, "PUT", url, `{"Id": "1", "Doc": "a"}`, http.Header{"If-Match": {"*"}})
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), Not(Equals), etag)
+	etag = res.Header.Get("ETag")
+
+	res = this.do(c, "PUT", url, `{"Id": "1", "Doc": "b"}`, http.Header{"If-Match": {`"xxx"`}})
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+
+	res = this.do(c, "PUT", url, `{"Id": "1", "Doc": "b"}`, http.Header{"If-Match": {etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), Not(Equals), etag)
+
+	res = this.do(c, "GET", url, "", http.Header{"If-None-Match": {etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	etag = res.Header.Get("ETag")
+
+	res = this.do(c, "DELETE", url, "", http.Header{"If-Match": {`"xxx"`}})
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+
+	res = this.do(c, "DELETE", url, "", http.Header{"If-Match": {etag}})
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	res = this.do(c, "GET", url, "", nil)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (this *MainSuite) TestChangesFeed(c *C) {
+	ts := httptest.NewServer(NewServer().Server.Handler)
+	defer ts.Close()
+
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/1", `{"Id": "1", "Doc": "a"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	res = this.do(c, "GET", ts.URL+"/db/table/_changes?feed=bogus", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusBadRequest)
+	res = this.do(c, "GET", ts.URL+"/db/table/_changes?feed=longpoll&since=1&timeout=x", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusBadRequest)
+
+	// a long-poll with nothing new times out with an empty result
+	start := time.Now()
+	res = this.do(c, "GET", ts.URL+"/db/table/_changes?feed=longpoll&since=1&timeout=50", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+	c.Check(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	// browsers send no Content-Type with an EventSource request
+	req, err := http.NewRequest("GET", ts.URL+"/db/table/_changes?feed=eventsource&timeout=5000", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Last-Event-ID", "0")
+	stream, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer stream.Body.Close()
+	c.Assert(stream.StatusCode, Equals, http.StatusOK)
+	c.Check(stream.Header.Get("Content-Type"), Equals, "text/event-stream")
+	reader := bufio.NewReader(stream.Body)
+	event := func() []string {
+		lines := []string{}
+		for {
+			line, err := reader.ReadString('\n')
+			c.Assert(err, IsNil)
+			if line == "\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	c.Check(event(), DeepEquals, []string{"id: 1", `data: {"Seq":1,"Id":"1","Rev":` + revOf(c, ts.URL+"/db/table/_id/1") + `}`})
+
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/2", `{"Id": "2", "Doc": "b"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	lines := event()
+	c.Assert(lines, HasLen, 2)
+	c.Check(lines[0], Equals, "id: 2")
+}
+
+func (this *MainSuite) TestRegistry(c *C) {
+	config := NewConfig()
+	config.DataDir = c.MkDir()
+	open := func() (*Server, *httptest.Server) {
+		srv, err := Open(config)
+		c.Assert(err, IsNil)
+		return srv, httptest.NewServer(srv.Server.Handler)
+	}
+	names := func(srv *Server) []string {
+		names := []string{}
+		for _, dbcfg := range srv.dbConfigs() {
+			names = append(names, dbcfg.Name)
+		}
+		return names
+	}
+
+	srv, ts := open()
+	res := this.do(c, "PUT", ts.URL+"/a", `{"Driver": "mem", "Config": {"tombstone_max": "1"}}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "PUT", ts.URL+"/b", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "PUT", ts.URL+"/b", `{"Driver": "mem", "Config": {"tombstone_max": "1"}}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusConflict)
+	c.Check(srv.dbs["b"].Config()["tombstone_max"], Equals, "")
+	ts.Close()
+
+	srv, ts = open()
+	c.Check(names(srv), DeepEquals, []string{"a", "b"})
+	c.Check(srv.dbs["a"].Config(), DeepEquals, kissdif.Dictionary{"tombstone_max": "1"})
+	res = this.do(c, "DELETE", ts.URL+"/a", "", nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	ts.Close()
+
+	srv, ts = open()
+	c.Check(names(srv), DeepEquals, []string{"b"})
+	ts.Close()
+
+	path := filepath.Join(config.DataDir, "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"Addr": ":9900", "DataDir": "/tmp/x"}`), 0644)
+	c.Assert(err, IsNil)
+	config = NewConfig()
+	c.Assert(config.Load(path), IsNil)
+	c.Check(config, DeepEquals, &Config{Addr: ":9900", DataDir: "/tmp/x"})
+}
+
+func (this *MainSuite) TestSharedFiles(c *C) {
+	dir := c.MkDir()
+	srv := NewServer()
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+	put := func(name, dbcfg string) int {
+		return this.do(c, "PUT", ts.URL+"/"+name, dbcfg, nil).StatusCode
+	}
+	c.Check(put("a", `{"Driver": "mem", "Config": {"dir": "`+dir+`/a"}}`), Equals, http.StatusOK)
+	c.Check(put("b", `{"Driver": "mem", "Config": {"dir": "`+dir+`/x/../a"}}`), Equals, http.StatusConflict)
+	c.Check(put("c", `{"Driver": "sql", "Config": {"dsn": "`+dir+`/c.db"}}`), Equals, http.StatusOK)
+	c.Check(put("d", `{"Driver": "sql", "Config": {"dsn": "file:`+dir+`/c.db?cache=shared"}}`), Equals, http.StatusConflict)
+	c.Check(put("e", `{"Driver": "sql", "Config": {"dsn": ":memory:"}}`), Equals, http.StatusOK)
+	c.Check(put("f", `{"Driver": "sql", "Config": {"dsn": ":memory:"}}`), Equals, http.StatusOK)
+	c.Check(put("g", `{"Driver": "mem"}`), Equals, http.StatusOK)
+	c.Check(put("h", `{"Driver": "mem"}`), Equals, http.StatusOK)
+	c.Check(srv.dbs["b"], IsNil)
+	c.Check(srv.dbs["d"], IsNil)
+}
+
+// closingDriver configures mem databases, counting those closed.
+type closingDriver struct {
+	closed int
+}
+
+type closingDb struct {
+	driver.Database
+	drv *closingDriver
+}
+
+func (this *closingDriver) Configure(name string, config kissdif.Dictionary) (driver.Database, *ergo.Error) {
+	drv, kerr := driver.Open("mem")
+	if kerr != nil {
+		return nil, kerr
+	}
+	db, kerr := drv.Configure(name, config)
+	if kerr != nil {
+		return nil, kerr
+	}
+	return &closingDb{db, this}, nil
+}
+
+func (this *closingDb) Close() *ergo.Error {
+	this.drv.closed++
+	return this.Database.Close()
+}
+
+var closing = new(closingDriver)
+
+func init() {
+	driver.Register("closing", closing)
+}
+
+func (this *MainSuite) TestRegistryFailure(c *C) {
+	config := NewConfig()
+	config.DataDir = c.MkDir()
+	registry := `[{"Name": "a", "Driver": "closing"}, {"Name": "b", "Driver": "closing"}, {"Name": "c", "Driver": "nope"}]`
+	err := ioutil.WriteFile(filepath.Join(config.DataDir, registryFile), []byte(registry), 0644)
+	c.Assert(err, IsNil)
+	closing.closed = 0
+	_, kerr := Open(config)
+	c.Assert(kerr, NotNil)
+	c.Check(kerr.Code, Equals, kissdif.EMissingDriver)
+	c.Check(closing.closed, Equals, 2)
+}
+
+func (this *MainSuite) TestRegistrySharedFiles(c *C) {
+	config := NewConfig()
+	config.DataDir = c.MkDir()
+	dir := c.MkDir()
+	registry := `[{"Name": "a", "Driver": "mem", "Config": {"dir": "` + dir + `/a"}}, ` +
+		`{"Name": "b", "Driver": "mem", "Config": {"dir": "` + dir + `/x/../a"}}]`
+	err := ioutil.WriteFile(filepath.Join(config.DataDir, registryFile), []byte(registry), 0644)
+	c.Assert(err, IsNil)
+	_, kerr := Open(config)
+	c.Assert(kerr, NotNil)
+	c.Check(kerr.Code, Equals, kissdif.EConflict)
+}
+
+func (this *MainSuite) TestStreamQuery(c *C) {
+	ts := httptest.NewServer(NewServer().Server.Handler)
+	defer ts.Close()
+
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	for _, id := range []string{"1", "2", "3"} {
+		res = this.do(c, "PUT", ts.URL+"/db/table/_id/"+id, `{"Id": "`+id+`", "Doc": "x"}`, nil)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/db/table/_id?stream=1&limit=2", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	stream, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer stream.Body.Close()
+	c.Assert(stream.StatusCode, Equals, http.StatusOK)
+	c.Check(stream.Header.Get("Content-Type"), Equals, "application/x-ndjson")
+	scanner := bufio.NewScanner(stream.Body)
+	chunks := []kissdif.Chunk{}
+	for scanner.Scan() {
+		var chunk kissdif.Chunk
+		c.Assert(json.Unmarshal(scanner.Bytes(), &chunk), IsNil)
+		chunks = append(chunks, chunk)
+	}
+	c.Assert(scanner.Err(), IsNil)
+	c.Assert(chunks, HasLen, 3)
+	c.Check(chunks[0].Record.Id, Equals, "1")
+	c.Check(chunks[1].Record.Id, Equals, "2")
+	c.Check(chunks[2].Record, IsNil)
+	c.Check(chunks[2].More, Equals, true)
+	c.Check(chunks[2].Cursor, Not(Equals), "")
+}
+
+// pagedStore sends two records, then waits for release before failing to
+// read the next page.
+type pagedStore struct {
+	store
+	release chan struct{}
+}
+
+func (this *pagedStore) Get(ctx context.Context, query *kissdif.Query) (chan (*kissdif.Record), *ergo.Error) {
+	first := true
+	return driver.Stream(ctx, query, func(query *kissdif.Query) ([]*kissdif.Record, bool, *ergo.Error) {
+		if first {
+			first = false
+			return []*kissdif.Record{{Id: "1", Cursor: "c1"}, {Id: "2", Cursor: "c2"}}, true, nil
+		}
+		<-this.release
+		return nil, false, kissdif.NewError(kissdif.EBadTable, "name", "table")
+	})
+}
+
+func (this *MainSuite) TestStreamFailure(c *C) {
+	srv := NewServer()
+	table := &pagedStore{release: make(chan struct{})}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := &ResponseWriter{ResponseWriter: &rest.ResponseWriter{ResponseWriter: w}, enc: json.NewEncoder(w)}
+		req := &Request{Request: &rest.Request{Request: r}, mediatype: "application/json"}
+		srv.streamQuery(resp, req, table, &kissdif.Query{Index: "_id", Limit: 10})
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	next := func() *kissdif.Chunk {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			var chunk kissdif.Chunk
+			c.Assert(json.Unmarshal([]byte(line), &chunk), IsNil)
+			return &chunk
+		case <-time.After(5 * time.Second):
+			c.Fatal("first page not flushed")
+			return nil
+		}
+	}
+
+	// the first page arrives while the next one is being read
+	c.Check(next().Record.Id, Equals, "1")
+	c.Check(next().Record.Id, Equals, "2")
+	close(table.release)
+	chunk := next()
+	c.Assert(chunk, NotNil)
+	c.Check(chunk.Record, IsNil)
+	c.Assert(chunk.Error, NotNil)
+	c.Check(chunk.Error.Code, Equals, kissdif.EBadTable)
+	c.Check(next(), IsNil)
+}
+
+func (this *MainSuite) TestTxTimeout(c *C) {
+	defer func(timeout time.Duration) { txTimeout = timeout }(txTimeout)
+	txTimeout = 50 * time.Millisecond
+	ts := httptest.NewServer(NewServer().Server.Handler)
+	defer ts.Close()
+
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "PUT", ts.URL+"/other", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	req, err := http.NewRequest("POST", ts.URL+"/db/_tx", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	var id string
+	err = json.NewDecoder(res.Body).Decode(&id)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/1?tx="+id, `{"Id": "1", "Doc": "a"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "GET", ts.URL+"/other/table/_id/1?tx="+id, "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusNotFound)
+
+	// an idle transaction is rolled back
+	time.Sleep(100 * time.Millisecond)
+	res = this.do(c, "POST", ts.URL+"/db/_tx/"+id, "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusNotFound)
+	res = this.do(c, "GET", ts.URL+"/db/table/_id/1", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+// TestSerialTx checks that a transaction can't hold up a database limited
+// to a single connection.
+func (this *MainSuite) TestSerialTx(c *C) {
+	ts := httptest.NewServer(NewServer().Server.Handler)
+	defer ts.Close()
+
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "sql", "Config": {"dsn": ":memory:"}}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "POST", ts.URL+"/db/_tx", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusNotImplemented)
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/1", `{"Id": "1", "Doc": "a"}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+
+	dsn := filepath.Join(c.MkDir(), "db")
+	res = this.do(c, "PUT", ts.URL+"/file", `{"Driver": "sql", "Config": {"dsn": "`+dsn+`"}}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "POST", ts.URL+"/file/_tx", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+}
+
+func (this *MainSuite) TestAuth(c *C) {
+	dir := c.MkDir()
+	users := Credentials{
+		"admin": {Salt: "s1", Hash: HashPasswordCost("s1", "secret", 10), Roles: map[string]string{"*": "admin"}},
+		"bob":   {Salt: "s2", Hash: HashPasswordCost("s2", "pw", 10), Roles: map[string]string{"db": "reader", "*": "writer"}},
+	}
+	raw, err := json.Marshal(users)
+	c.Assert(err, IsNil)
+	config := NewConfig()
+	config.Credentials = filepath.Join(dir, "users.json")
+	config.TokenKeyFile = filepath.Join(dir, "token.key")
+	c.Assert(ioutil.WriteFile(config.Credentials, raw, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(config.TokenKeyFile, []byte("key\n"), 0600), IsNil)
+	srv, kerr := Open(config)
+	c.Assert(kerr, IsNil)
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+
+	basic := func(user, password string) http.Header {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(user, password)
+		return req.Header
+	}
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusUnauthorized)
+	c.Check(res.Header.Get("WWW-Authenticate"), Equals, `Basic realm="kissdif"`)
+	res = this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, basic("admin", "wrong"))
+	c.Check(res.StatusCode, Equals, http.StatusUnauthorized)
+	res = this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusForbidden)
+	res = this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, basic("admin", "secret"))
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	// bob may only read db
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/1", `{"Id": "1", "Doc": "a"}`, basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusForbidden)
+	res = this.do(c, "PUT", ts.URL+"/db/table/_id/1", `{"Id": "1", "Doc": "a"}`, basic("admin", "secret"))
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "GET", ts.URL+"/db/table/_id/1", "", basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "DELETE", ts.URL+"/db/table", "", basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusForbidden)
+	res = this.do(c, "POST", ts.URL+"/db/_tx", "", basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusForbidden)
+
+	// a transaction is only seen by the user who began it
+	res = this.do(c, "PUT", ts.URL+"/db2", `{"Driver": "mem"}`, basic("admin", "secret"))
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	req, err := http.NewRequest("POST", ts.URL+"/db2/_tx", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("bob", "pw")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	var tx string
+	err = json.NewDecoder(res.Body).Decode(&tx)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	res = this.do(c, "PUT", ts.URL+"/db2/table/_id/1?tx="+tx, `{"Id": "1", "Doc": "a"}`, basic("admin", "secret"))
+	c.Check(res.StatusCode, Equals, http.StatusNotFound)
+	res = this.do(c, "POST", ts.URL+"/db2/_tx/"+tx, "", basic("admin", "secret"))
+	c.Check(res.StatusCode, Equals, http.StatusNotFound)
+	res = this.do(c, "PUT", ts.URL+"/db2/table/_id/1?tx="+tx, `{"Id": "1", "Doc": "a"}`, basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "POST", ts.URL+"/db2/_tx/"+tx, "", basic("bob", "pw"))
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+
+	req, err = http.NewRequest("POST", ts.URL+"/_token", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("bob", "pw")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	var token string
+	err = json.NewDecoder(res.Body).Decode(&token)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+
+	bearer := http.Header{"Authorization": {"Bearer " + token}}
+	res = this.do(c, "GET", ts.URL+"/db/table/_id/1", "", bearer)
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "GET", ts.URL+"/db/table/_id/1", "", http.Header{"Authorization": {"Bearer x" + token}})
+	c.Check(res.StatusCode, Equals, http.StatusUnauthorized)
+	expired := srv.tokens.Issue("bob", -time.Second)
+	res = this.do(c, "GET", ts.URL+"/db/table/_id/1", "", http.Header{"Authorization": {"Bearer " + expired}})
+	c.Check(res.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+// slowAuth lets every request in as admin once release is closed.
+type slowAuth struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (this *slowAuth) Authenticate(req *http.Request) (string, *ergo.Error) {
+	this.entered <- struct{}{}
+	<-this.release
+	return "admin", nil
+}
+
+func (this *MainSuite) TestListDbsSlowAuth(c *C) {
+	srv := NewServer()
+	auth := &slowAuth{entered: make(chan struct{}), release: make(chan struct{})}
+	srv.SetAuth(Credentials{"admin": {Roles: map[string]string{"*": "admin"}}}, auth)
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	done := make(chan interface{})
+	go func() {
+		done <- srv.listDbs(nil, &Request{Request: &rest.Request{Request: req}})
+	}()
+	<-auth.entered
+
+	// the databases may be changed while the user is being authenticated
+	locked := make(chan struct{})
+	go func() {
+		srv.mutex.Lock()
+		srv.mutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		c.Fatal("databases locked while authenticating")
+	}
+	close(auth.release)
+	c.Check(<-done, DeepEquals, []kissdif.DatabaseCfg{})
+}
+
+func (this *MainSuite) TestHashPassword(c *C) {
+	// the PBKDF2-HMAC-SHA256 test vector of RFC 7914
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	c.Check(hex.EncodeToString(key), Equals, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"+
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783")
+
+	user, kerr := NewUser("pw")
+	c.Assert(kerr, IsNil)
+	c.Check(strings.HasPrefix(user.Hash, "pbkdf2-sha256$100000$"), Equals, true)
+	users := Credentials{"bob": user}
+	c.Check(users.Check("bob", "pw"), Equals, true)
+	c.Check(users.Check("bob", "wrong"), Equals, false)
+	c.Check(users.Check("eve", "pw"), Equals, false)
+
+	// hashes in any other form are refused
+	path := filepath.Join(c.MkDir(), "users.json")
+	legacy := `{"bob": {"Salt": "s", "Hash": "4a0b1c", "Roles": {"*": "reader"}}}`
+	c.Assert(ioutil.WriteFile(path, []byte(legacy), 0600), IsNil)
+	_, kerr = LoadCredentials(path)
+	c.Assert(kerr, NotNil)
+	c.Check(kerr.Code, Equals, kissdif.EBadParam)
+}
+
+func (this *MainSuite) TestSchema(c *C) {
+	config := NewConfig()
+	config.DataDir = c.MkDir()
+	srv, kerr := Open(config)
+	c.Assert(kerr, IsNil)
+	ts := httptest.NewServer(srv.Server.Handler)
+	defer ts.Close()
+	decode := func(method, url, body string, v interface{}) int {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(json.NewDecoder(res.Body).Decode(v), IsNil)
+		return res.StatusCode
+	}
+
+	res := this.do(c, "PUT", ts.URL+"/db", `{"Driver": "mem"}`, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "PUT", ts.URL+"/db/users/_schema", `{"type": "object", "pattern": "("}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusBadRequest)
+	schema := `{
+		"type": "object",
+		"required": ["name"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}}
+		}
+	}`
+	res = this.do(c, "PUT", ts.URL+"/db/users/_schema", schema, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	res = this.do(c, "PUT", ts.URL+"/db/users/_id/1", `{"Id": "1", "Doc": {"name": "x", "age": 3, "tags": ["a"]}}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+	var reply struct {
+		Code    int
+		Context struct{ Errors []string }
+	}
+	status := decode("PUT", ts.URL+"/db/users/_id/2",
+		`{"Id": "2", "Doc": {"age": 1.5, "tags": ["c"], "extra": true}}`, &reply)
+	c.Check(status, Equals, http.StatusUnprocessableEntity)
+	c.Check(reply.Code, Equals, int(kissdif.EInvalid))
+	c.Check(reply.Context.Errors, DeepEquals, []string{
+		`/: missing property "name"`,
+		"/age: expected integer",
+		`/: unexpected property "extra"`,
+		"/tags/0: not one of the allowed values",
+	})
+
+	// a partial bulk write only fails the records that don't match
+	var results []kissdif.BulkResult
+	status = decode("POST", ts.URL+"/db/users/_bulk",
+		`{"Records": [{"Id": "3", "Doc": {"name": "y"}}, {"Id": "4", "Doc": {"name": ""}}], "Partial": true}`, &results)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].Error, IsNil)
+	c.Check(results[1].Id, Equals, "4")
+	c.Assert(results[1].Error, NotNil)
+	c.Check(results[1].Error.Code, Equals, kissdif.EInvalid)
+	res = this.do(c, "POST", ts.URL+"/db/users/_bulk",
+		`{"Records": [{"Id": "5", "Doc": {"name": "z"}}, {"Id": "6", "Doc": {}}]}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusUnprocessableEntity)
+	res = this.do(c, "GET", ts.URL+"/db/users/_id/5", "", nil)
+	c.Check(res.StatusCode, Equals, http.StatusNotFound)
+
+	// the schema is recorded along with the database
+	srv, kerr = Open(config)
+	c.Assert(kerr, IsNil)
+	ts2 := httptest.NewServer(srv.Server.Handler)
+	defer ts2.Close()
+	var doc map[string]interface{}
+	status = decode("GET", ts2.URL+"/db/users/_schema", "", &doc)
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(doc["required"], DeepEquals, []interface{}{"name"})
+	res = this.do(c, "PUT", ts2.URL+"/db/users/_id/7", `{"Id": "7", "Doc": {}}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusUnprocessableEntity)
+	res = this.do(c, "DELETE", ts2.URL+"/db/users/_schema", "", nil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res = this.do(c, "PUT", ts2.URL+"/db/users/_id/7", `{"Id": "7", "Doc": {}}`, nil)
+	c.Check(res.StatusCode, Equals, http.StatusOK)
+}
+
+func revOf(c *C, url string) string {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	return res.Header.Get("ETag")
+}